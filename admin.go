@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"git.clsr.net/gomf/storage"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func runCommand(args []string) int {
+	switch args[0] {
+	case "admin":
+		return runAdmin(args[1:])
+	case "logs":
+		return runLogs(args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+	return 2
+}
+
+const adminUsage = `usage: gomf [options] admin COMMAND [-json] [ARGS]
+
+commands:
+	info ID...
+		show the hash, size, name, upload time and MIME type of files and all
+		IDs referring to the same files
+	rm ID...
+		remove IDs, and the files they refer to if no other IDs refer to them
+	rm-link ID...
+		remove short links
+	rm-album ID...
+		remove albums, but not the files in them
+	rm-hash HASH...
+		remove the files with the given SHA-1 hashes and all IDs referring to them
+	block ID...
+		remove the files with the given IDs along with all other IDs of the same
+		files and block their hashes from being uploaded again
+	ls [-since TIME] [-larger-than BYTES] [-mime TYPES]
+		list uploaded files; TIME is a duration (e.g. 24h) or a date (2006-01-02
+		or RFC 3339), TYPES is a comma-separated list of MIME types or prefixes
+		ending with a slash
+	stats
+		show the count of stored files and IDs, the total size of stored files
+		and the space saved by deduplication
+	log-hash [-key-id ID] VALUE...
+		hash values (e.g. IP addresses) the way they are hashed in log entries
+		with the given key_id, or in current entries if it is not given; the
+		same -log-hash-key, -log-hash-rotate and -log-hash-salt options as the
+		server must be used
+`
+
+type adminCommand struct {
+	flags *flag.FlagSet
+	json  bool
+}
+
+func newAdminCommand(name string) *adminCommand {
+	cmd := &adminCommand{flags: flag.NewFlagSet(name, flag.ContinueOnError)}
+	cmd.flags.BoolVar(&cmd.json, "json", false, "output JSON")
+	cmd.flags.Usage = func() { fmt.Fprint(os.Stderr, adminUsage) }
+	return cmd
+}
+
+func (cmd *adminCommand) output(v interface{}, table func(w *tabwriter.Writer)) {
+	if cmd.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		enc.Encode(v)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	table(w)
+	w.Flush()
+}
+
+func runAdmin(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, adminUsage)
+		return 2
+	}
+	cmd := newAdminCommand(args[0])
+	var run func(args []string) int
+	switch args[0] {
+	case "info":
+		run = cmd.info
+	case "rm":
+		run = cmd.rm
+	case "rm-link":
+		run = cmd.rmLink
+	case "rm-album":
+		run = cmd.rmAlbum
+	case "rm-hash":
+		run = cmd.rmHash
+	case "block":
+		run = cmd.block
+	case "ls":
+		run = cmd.ls()
+	case "stats":
+		run = cmd.stats
+	case "log-hash":
+		run = cmd.logHash()
+	default:
+		fmt.Fprint(os.Stderr, adminUsage)
+		return 2
+	}
+	if err := cmd.flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	return run(cmd.flags.Args())
+}
+
+func (cmd *adminCommand) info(ids []string) int {
+	status := 0
+	infos := []*storage.Info{}
+	for _, id := range ids {
+		info, err := uploads.Info(id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", id, err)
+			status = 1
+			continue
+		}
+		infos = append(infos, info)
+	}
+	cmd.output(infos, func(w *tabwriter.Writer) {
+		for _, info := range infos {
+			fmt.Fprintf(w, "id:\t%s\n", info.Id)
+			fmt.Fprintf(w, "name:\t%s\n", info.Name)
+			fmt.Fprintf(w, "hash:\t%s\n", info.Hash)
+			fmt.Fprintf(w, "size:\t%d (%s)\n", info.Size, humanize(info.Size))
+			fmt.Fprintf(w, "time:\t%s\n", info.Time.UTC().Format(time.RFC3339))
+			fmt.Fprintf(w, "mime:\t%s\n", info.Mime)
+			fmt.Fprintf(w, "downloads:\t%d\n", info.Downloads)
+			if info.Encrypted {
+				fmt.Fprintf(w, "encrypted:\tyes\n")
+			}
+			fmt.Fprintf(w, "ids:\t%s\n\n", strings.Join(info.Ids, " "))
+		}
+	})
+	return status
+}
+
+func (cmd *adminCommand) removed(args []string, results map[string][]string, status int) int {
+	cmd.output(results, func(w *tabwriter.Writer) {
+		for _, arg := range args {
+			if ids, ok := results[arg]; ok {
+				fmt.Fprintf(w, "%s:\tremoved %s\n", arg, strings.Join(ids, " "))
+			}
+		}
+	})
+	return status
+}
+
+func (cmd *adminCommand) rm(ids []string) int {
+	status := 0
+	results := make(map[string][]string)
+	for _, id := range ids {
+		if err := uploads.Remove(id); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", id, err)
+			status = 1
+			continue
+		}
+		results[id] = []string{id}
+	}
+	return cmd.removed(ids, results, status)
+}
+
+func (cmd *adminCommand) rmLink(ids []string) int {
+	status := 0
+	results := make(map[string][]string)
+	for _, id := range ids {
+		if err := uploads.RemoveLink(id); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", id, err)
+			status = 1
+			continue
+		}
+		results[id] = []string{id}
+	}
+	return cmd.removed(ids, results, status)
+}
+
+func (cmd *adminCommand) rmAlbum(ids []string) int {
+	status := 0
+	results := make(map[string][]string)
+	for _, id := range ids {
+		if err := uploads.RemoveAlbum(id); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", id, err)
+			status = 1
+			continue
+		}
+		results[id] = []string{id}
+	}
+	return cmd.removed(ids, results, status)
+}
+
+func (cmd *adminCommand) rmHash(hashes []string) int {
+	status := 0
+	results := make(map[string][]string)
+	for _, hash := range hashes {
+		ids, err := uploads.RemoveHash(strings.ToLower(hash))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", hash, err)
+			status = 1
+			continue
+		}
+		results[hash] = ids
+	}
+	return cmd.removed(hashes, results, status)
+}
+
+func (cmd *adminCommand) block(ids []string) int {
+	status := 0
+	results := make(map[string][]string)
+	for _, id := range ids {
+		removed, err := uploads.Block(id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", id, err)
+			status = 1
+			continue
+		}
+		results[id] = removed
+	}
+	return cmd.removed(ids, results, status)
+}
+
+func parseTime(str string) (time.Time, error) {
+	if d, err := time.ParseDuration(str); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse("2006-01-02", str); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, str)
+}
+
+func matchMime(types []string, mimetype string) bool {
+	for _, t := range types {
+		if t == mimetype || (strings.HasSuffix(t, "/") && strings.HasPrefix(mimetype, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cmd *adminCommand) ls() func(args []string) int {
+	sinceStr := cmd.flags.String("since", "", "only list files uploaded after this time")
+	largerThan := cmd.flags.Int64("larger-than", -1, "only list files larger than this many bytes")
+	mimeStr := cmd.flags.String("mime", "", "only list files of these MIME types")
+	return func(args []string) int {
+		return cmd.list(*sinceStr, *largerThan, *mimeStr)
+	}
+}
+
+func (cmd *adminCommand) list(sinceStr string, largerThan int64, mimeStr string) int {
+	var since time.Time
+	if sinceStr != "" {
+		var err error
+		if since, err = parseTime(sinceStr); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid time:", sinceStr)
+			return 2
+		}
+	}
+	var types []string
+	if mimeStr != "" {
+		types = strings.Split(mimeStr, ",")
+	}
+
+	infos := []*storage.Info{}
+	err := uploads.Walk(true, func(info *storage.Info) error {
+		if info.Time.Before(since) || info.Size <= largerThan || (types != nil && !matchMime(types, info.Mime)) {
+			return nil
+		}
+		infos = append(infos, info)
+		return nil
+	}, func(id string, err error) {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", id, err)
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cmd.output(infos, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "ID\tSIZE\tTIME\tMIME\tHASH\tNAME")
+		for _, info := range infos {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", info.Id, strconv.FormatInt(info.Size, 10), info.Time.UTC().Format(time.RFC3339), info.Mime, info.Hash, info.Name)
+		}
+	})
+	return 0
+}
+
+func (cmd *adminCommand) stats(args []string) int {
+	stats, err := uploads.Stats()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cmd.output(stats, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "stored files:\t%d\n", stats.Blobs)
+		fmt.Fprintf(w, "IDs:\t%d\n", stats.Ids)
+		fmt.Fprintf(w, "stored bytes:\t%d (%s)\n", stats.Bytes, humanize(stats.Bytes))
+		fmt.Fprintf(w, "bytes on disk:\t%d (%s)\n", stats.DiskBytes, humanize(stats.DiskBytes))
+		fmt.Fprintf(w, "uploaded bytes:\t%d (%s)\n", stats.LogicalBytes, humanize(stats.LogicalBytes))
+		fmt.Fprintf(w, "dedup savings:\t%d (%s)\n", stats.DedupSavings, humanize(stats.DedupSavings))
+	})
+	return 0
+}
+
+func (cmd *adminCommand) logHash() func(args []string) int {
+	keyId := cmd.flags.String("key-id", "", "key ID of the log entries")
+	return func(values []string) int {
+		if *keyId == "" {
+			_, *keyId = DefaultLogger.hashKey(time.Now())
+		}
+		status := 0
+		hashes := make(map[string]string)
+		for _, v := range values {
+			hash, err := DefaultLogger.HashWithKeyId(v, *keyId)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", v, err)
+				status = 1
+				continue
+			}
+			hashes[v] = hash
+		}
+		cmd.output(hashes, func(w *tabwriter.Writer) {
+			for _, v := range values {
+				if hash, ok := hashes[v]; ok {
+					fmt.Fprintf(w, "%s:\t%s\n", v, hash)
+				}
+			}
+		})
+		return status
+	}
+}
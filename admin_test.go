@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"git.clsr.net/gomf/storage"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// runAdminOutput runs an admin command and returns its exit code and output
+func runAdminOutput(t *testing.T, dir string, args ...string) (int, string) {
+	out, err := ioutil.TempFile(dir, "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	code := runAdmin(args)
+	os.Stdout = stdout
+	data, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code, string(data)
+}
+
+func adminUpload(t *testing.T, content, name string) string {
+	id, _, _, _, err := uploads.New(strings.NewReader(content), name, storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestAdminBlock(t *testing.T) {
+	dir := setupTest(t)
+	id := adminUpload(t, "blocked content", "a.txt")
+	dup := adminUpload(t, "blocked content", "b.txt")
+	other := adminUpload(t, "other content", "c.txt")
+
+	code, out := runAdminOutput(t, dir, "block", "-json", id, "zzzzzz")
+	if code != 1 {
+		t.Errorf("exit code %d with an unknown ID, want 1", code)
+	}
+	var results map[string][]string
+	if err := json.Unmarshal([]byte(out), &results); err != nil {
+		t.Fatalf("invalid output %q: %s", out, err)
+	}
+	removed := results[id]
+	sort.Strings(removed)
+	want := []string{id, dup}
+	sort.Strings(want)
+	if len(results) != 1 || !reflect.DeepEqual(removed, want) {
+		t.Errorf("block removed %v, want %v", results, want)
+	}
+
+	for _, i := range []string{id, dup} {
+		if _, _, _, _, err := uploads.Get(i); err == nil {
+			t.Errorf("%s is still available", i)
+		}
+	}
+	if _, _, _, _, err := uploads.New(strings.NewReader("blocked content"), "d.txt", storage.Options{}); err == nil {
+		t.Error("blocked content was uploaded again")
+	} else if _, ok := err.(storage.ErrBlocked); !ok {
+		t.Errorf("re-upload: got %v, want storage.ErrBlocked", err)
+	}
+	if _, _, _, _, err := uploads.Get(other); err != nil {
+		t.Errorf("other file: %s", err)
+	}
+}
+
+func TestAdminRmHash(t *testing.T) {
+	dir := setupTest(t)
+	ids := []string{adminUpload(t, "first", "a.txt"), adminUpload(t, "second", "b.txt"), adminUpload(t, "third", "c.txt")}
+	var hashes []string
+	for _, id := range ids {
+		info, err := uploads.Info(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, info.Hash)
+	}
+
+	// hashes are case-insensitive, and the results are printed in the order
+	// of the arguments
+	code, out := runAdminOutput(t, dir, "rm-hash", hashes[2], strings.ToUpper(hashes[0]))
+	if code != 0 {
+		t.Errorf("exit code %d, want 0", code)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], hashes[2]+":") || !strings.HasPrefix(lines[1], strings.ToUpper(hashes[0])+":") {
+		t.Errorf("output %q", out)
+	}
+	for i, id := range ids {
+		_, _, _, _, err := uploads.Get(id)
+		if removed := i != 1; removed != (err != nil) {
+			t.Errorf("%s: removed %v, want %v (%v)", id, err != nil, removed, err)
+		}
+	}
+
+	if code, _ = runAdminOutput(t, dir, "rm-hash", hashes[0]); code != 1 {
+		t.Errorf("exit code %d for a removed hash, want 1", code)
+	}
+}
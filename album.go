@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+var albumUrl string
+
+func init() {
+	builtinPages["_album.html"] = albumPage
+}
+
+type albumFile struct {
+	Url       string `json:"url"`
+	Name      string `json:"name"`
+	Hash      string `json:"hash"`
+	Size      int64  `json:"size"`
+	Mime      string `json:"mime"`
+	Thumbnail string `json:"thumbnail,omitempty"`
+}
+
+type albumInfo struct {
+	Id      string      `json:"id"`
+	Url     string      `json:"url"`
+	Zip     string      `json:"zip"`
+	Created time.Time   `json:"created"`
+	Files   []albumFile `json:"files"`
+}
+
+type albumContext struct {
+	pageContext
+	Album albumInfo
+}
+
+// newAlbum groups the files of a successful upload response into an album
+func newAlbum(resp *response) {
+	ids := []string{}
+	for _, res := range resp.Files {
+		ids = append(ids, path.Base(res.Url))
+	}
+	id, err := uploads.NewAlbum(ids)
+	if err != nil {
+		resp.ErrorCode = http.StatusInternalServerError
+		resp.Description = err.Error()
+		return
+	}
+	resp.Album = strings.TrimRight(albumUrl, "/") + "/" + id
+}
+
+// handleAlbum serves /a/ID as a gallery page, /a/ID/json as JSON and
+// /a/ID/zip and /a/ID/tar as archives of the files
+func handleAlbum(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/a/")
+	action := ""
+	if i := strings.Index(id, "/"); i >= 0 {
+		id, action = id[:i], id[i+1:]
+	}
+	album, err := uploads.GetAlbum(id)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+
+	switch action {
+	case "zip", "tar":
+		writeArchive(w, album.Ids, true, action, id)
+		return
+	case "json", "":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	info := albumInfo{
+		Id:      id,
+		Url:     strings.TrimRight(albumUrl, "/") + "/" + id,
+		Created: album.Created,
+		Files:   []albumFile{},
+	}
+	info.Zip = info.Url + "/zip"
+	for _, fid := range album.Ids {
+		// removed and disabled files are left out
+		if meta, err := uploads.GetMeta(fid); err != nil || meta.Disabled {
+			continue
+		}
+		fi, err := uploads.FileInfo(fid)
+		if err != nil {
+			continue
+		}
+		f := albumFile{
+			Url:  strings.TrimRight(uploadUrl, "/") + "/" + fid,
+			Name: fi.Name,
+			Hash: fi.Hash,
+			Size: fi.Size,
+			Mime: fi.Mime,
+		}
+		if uploads.HasThumbnail(fid) {
+			f.Thumbnail = f.Url + "/thumb"
+		}
+		info.Files = append(info.Files, f)
+	}
+
+	if action == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src *; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := templates.ExecuteTemplate(w, "_album.html", albumContext{pageContext: newContext(), Album: info}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+const albumPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Album &middot; {{.SiteName}}</title>
+<style>
+body { margin: 1em 2em; font-family: sans-serif; }
+.thumbs a { display: inline-block; margin: 0.25em; }
+.thumbs img { max-width: 200px; max-height: 200px; }
+</style>
+</head>
+<body>
+<h1>{{.SiteName}}</h1>
+<p>{{len .Album.Files}} files &middot; <a href="{{.Album.Zip}}">Download all as zip</a> &middot; <a href="{{.Album.Url}}/json">JSON</a></p>
+<div class="thumbs">
+{{range .Album.Files}}{{if .Thumbnail}}<a href="{{.Url}}" title="{{.Name}}"><img src="{{.Thumbnail}}" alt="{{.Name}}"></a>{{end}}
+{{end}}
+</div>
+<ul>
+{{range .Album.Files}}{{if not .Thumbnail}}<li><a href="{{.Url}}">{{.Name}}</a> ({{.Size}} bytes)</li>{{end}}
+{{end}}
+</ul>
+</body>
+</html>
+`
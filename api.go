@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"git.clsr.net/gomf/storage"
 	"io"
+	"io/ioutil"
 	"mime"
 	"net/http"
 	"net/url"
@@ -27,32 +28,71 @@ func asciiOnly(str string) string {
 	}, str)
 }
 
+func parseBool(str string, def bool) bool {
+	if v, err := strconv.ParseBool(strings.TrimSpace(str)); err == nil {
+		return v
+	}
+	return def
+}
+
 func percentEscape(str string) string {
 	return strings.Replace(url.QueryEscape(str), "+", "%20", -1)
 }
 
+func storageErrorCode(err error) int {
+	if _, ok := err.(storage.ErrNotFound); ok || err == storage.ErrNoThumbnail {
+		return http.StatusNotFound
+	} else if _, ok := err.(storage.ErrBlocked); ok {
+		return http.StatusUnavailableForLegalReasons
+	} else if _, ok := err.(storage.ErrDisabled); ok {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+func storageError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), storageErrorCode(err))
+}
+
 func handleFile(w http.ResponseWriter, r *http.Request) {
-	f, hash, size, modtime, err := uploads.Get(strings.TrimLeft(r.URL.Path, "/"))
-	if err != nil {
-		if _, ok := err.(storage.ErrNotFound); ok {
-			http.Error(w, err.Error(), http.StatusNotFound)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	id := strings.TrimLeft(r.URL.Path, "/")
+	if i := strings.Index(id, "/"); i >= 0 {
+		switch id[i+1:] {
+		case "decrypt":
+			handleDecrypt(w, r, id[:i])
+		case "thumb":
+			handleThumbnail(w, r, id[:i])
+		case "view":
+			handleView(w, r, id[:i])
+		default:
+			http.NotFound(w, r)
 		}
 		return
 	}
+
+	f, hash, size, modtime, err := uploads.Get(id)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
 	defer f.Close()
 
+	meta := setInfoHeaders(w, r, id, hash, size, modtime)
+
 	name := path.Base(f.Name())
 	mtype := mime.TypeByExtension(path.Ext(f.Name()))
 	if !allowHtml && (strings.Index(mtype, "text/html") == 0 || strings.Index(mtype, "application/xhtml+xml") == 0) {
 		mtype = "text/plain"
 	}
-	if mtype == "" {
+	disposition := "inline"
+	if mtype == "" || meta.Encrypted {
+		// the type of client-side encrypted files is unknown to the server
 		mtype = "application/octet-stream"
 	}
+	if meta.Encrypted {
+		disposition = "attachment"
+	}
 	w.Header().Set("Content-Type", mtype)
-	_ = size
 	if csp != "" {
 		w.Header().Set("Content-Security-Policy", csp)
 	}
@@ -61,17 +101,66 @@ func handleFile(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Expires", time.Now().UTC().Add(time.Hour*24*30).Format(http.TimeFormat))
 	w.Header().Set("Cache-Control", "max-age=2592000")
 	// in theory you should make the filename ascii-only, but curl/wget don't support extended fields yet
-	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"; filename*=UTF-8''%s", strings.Replace(name, "\"", "\\\"", -1), percentEscape(name)))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=\"%s\"; filename*=UTF-8''%s", disposition, strings.Replace(name, "\"", "\\\"", -1), percentEscape(name)))
+	var content io.ReadSeeker = f
+	if gz := f.Gzip(); gz != nil {
+		w.Header().Set("Vary", "Accept-Encoding")
+		// ranges are served from the decompressed file
+		if r.Header.Get("Range") == "" && acceptsGzip(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+			hash += "+gzip"
+			content = gz
+		}
+	}
 	w.Header().Set("ETag", "\"sha1:"+hash+"\"")
 	//io.Copy(w, f)
+	http.ServeContent(w, r, "", modtime, content)
+}
+
+func handleThumbnail(w http.ResponseWriter, r *http.Request, id string) {
+	f, modtime, err := uploads.Thumbnail(id)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(f.Name())))
+	if csp != "" {
+		w.Header().Set("Content-Security-Policy", csp)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "max-age=2592000")
 	http.ServeContent(w, r, "", modtime, f)
 }
 
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			if q := strings.Replace(param, " ", "", -1); strings.HasPrefix(q, "q=") {
+				v, err := strconv.ParseFloat(q[2:], 64)
+				return err == nil && v > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
 type result struct {
 	Url  string `json:"url"`
 	Name string `json:"name"`
 	Hash string `json:"hash"`
 	Size int64  `json:"size"`
+
+	Encrypted bool   `json:"encrypted,omitempty"`
+	Stripped  bool   `json:"stripped,omitempty"`
+	Thumbnail string `json:"thumbnail,omitempty"`
+	Expires   string `json:"expires,omitempty"`
 }
 
 type response struct {
@@ -79,12 +168,18 @@ type response struct {
 	ErrorCode   int      `json:"errorcode,omitempty"`
 	Description string   `json:"description,omitempty"`
 	Files       []result `json:"files,omitempty"`
+	Album       string   `json:"album,omitempty"`
 }
 
 func handleUpload(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	output := r.FormValue("output")
 	resp := response{Files: []result{}}
+	opts := storage.Options{
+		Encrypted:     parseBool(r.FormValue("encrypted"), false),
+		StripMetadata: parseBool(r.FormValue("strip"), stripMetadata),
+	}
+	album := parseBool(r.FormValue("album"), false)
 
 	if r.Method == http.MethodGet && (output == "html" || output == "") {
 		respond(w, output, resp)
@@ -93,8 +188,19 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 
 	mr, err := r.MultipartReader()
 	if err != nil {
-		resp.ErrorCode = http.StatusInternalServerError
-		resp.Description = err.Error()
+		if urls := r.PostForm["url"]; len(urls) > 0 {
+			for _, u := range urls {
+				if !uploadFromUrl(r, &resp, u, opts) {
+					break
+				}
+			}
+		} else {
+			resp.ErrorCode = http.StatusInternalServerError
+			resp.Description = err.Error()
+		}
+		if album && resp.ErrorCode == 0 && len(resp.Files) > 0 {
+			newAlbum(&resp)
+		}
 		respond(w, output, resp)
 		return
 	}
@@ -109,38 +215,151 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 
+		if part.FormName() == "encrypted" {
+			v, _ := ioutil.ReadAll(io.LimitReader(part, 16))
+			opts.Encrypted = parseBool(string(v), opts.Encrypted)
+			continue
+		}
+		if part.FormName() == "strip" {
+			v, _ := ioutil.ReadAll(io.LimitReader(part, 16))
+			opts.StripMetadata = parseBool(string(v), opts.StripMetadata)
+			continue
+		}
+		if part.FormName() == "album" {
+			v, _ := ioutil.ReadAll(io.LimitReader(part, 16))
+			album = parseBool(string(v), album)
+			continue
+		}
+		if part.FormName() == "url" {
+			v, _ := ioutil.ReadAll(io.LimitReader(part, maxFetchUrl+1))
+			if !uploadFromUrl(r, &resp, string(v), opts) {
+				break
+			}
+			continue
+		}
 		if part.FormName() != "files[]" {
 			continue
 		}
 
-		id, hash, size, err := uploads.New(part, part.FileName())
-		if err != nil {
-			resp.ErrorCode = http.StatusInternalServerError
-			resp.Description = err.Error()
-			if _, ok := err.(storage.ErrTooLarge); ok {
-				resp.ErrorCode = http.StatusRequestEntityTooLarge
-			} else if _, ok := err.(storage.ErrForbidden); ok {
-				resp.ErrorCode = http.StatusForbidden
-			}
+		ok := store(r, &resp, part, part.FileName(), opts)
+		part.Close()
+		if !ok {
 			break
 		}
+	}
 
-		bhash, _ := base64.RawURLEncoding.DecodeString(hash)
-		res := result{
-			Name: part.FileName(),
-			Url:  strings.TrimRight(uploadUrl, "/") + "/" + id,
-			Hash: hex.EncodeToString(bhash),
-			Size: size,
-		}
-		LogUpload(r, res)
-		resp.Files = append(resp.Files, res)
+	if album && resp.ErrorCode == 0 && len(resp.Files) > 0 {
+		newAlbum(&resp)
+	}
+	respond(w, output, resp)
+}
 
-		part.Close()
+// handleRawUpload stores the request body as a file named after the last
+// element of the path for PUT requests or the name query parameter for POST
+// requests, and responds with its URL as text by default
+func handleRawUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "The method is not allowed for the requested URL.", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	output := query.Get("output")
+	if output == "" {
+		output = "text"
+	}
+	resp := response{Files: []result{}}
+	opts := storage.Options{
+		Encrypted:     parseBool(query.Get("encrypted"), false),
+		StripMetadata: parseBool(query.Get("strip"), stripMetadata),
+	}
+
+	name := query.Get("name")
+	if r.Method == http.MethodPut {
+		name = path.Base(r.URL.Path)
+	}
+	if name == "" || name == "/" || name == "." {
+		name = "file"
 	}
 
+	if uploads.MaxSize > 0 && r.ContentLength > uploads.MaxSize {
+		err := storage.ErrTooLarge{Size: uploads.MaxSize}
+		observeUpload(err, 0)
+		resp.ErrorCode = http.StatusRequestEntityTooLarge
+		resp.Description = err.Error()
+	} else {
+		store(r, &resp, r.Body, name, opts)
+	}
 	respond(w, output, resp)
 }
 
+// store stores an uploaded file and adds it to the response; it returns
+// false and sets the response error if storing fails
+func store(r *http.Request, resp *response, rd io.Reader, name string, opts storage.Options) bool {
+	id, hash, size, stripped, err := uploads.New(rd, name, opts)
+	observeUpload(err, size)
+	if err != nil {
+		resp.ErrorCode = http.StatusInternalServerError
+		resp.Description = err.Error()
+		if _, ok := err.(storage.ErrTooLarge); ok {
+			resp.ErrorCode = http.StatusRequestEntityTooLarge
+		} else if _, ok := err.(storage.ErrForbidden); ok {
+			resp.ErrorCode = http.StatusForbidden
+		} else if _, ok := err.(storage.ErrBlocked); ok {
+			resp.ErrorCode = http.StatusUnavailableForLegalReasons
+		} else if _, ok := err.(storage.ErrInfected); ok {
+			resp.ErrorCode = http.StatusUnprocessableEntity
+		} else if _, ok := err.(storage.ErrScanFailed); ok {
+			resp.ErrorCode = http.StatusServiceUnavailable
+		} else if _, ok := err.(errFetch); ok {
+			resp.ErrorCode = http.StatusBadGateway
+		}
+		return false
+	}
+
+	bhash, _ := base64.RawURLEncoding.DecodeString(hash)
+	res := result{
+		Name: name,
+		Url:  strings.TrimRight(uploadUrl, "/") + "/" + id,
+		Hash: hex.EncodeToString(bhash),
+		Size: size,
+
+		Encrypted: opts.Encrypted,
+		Stripped:  stripped,
+	}
+	if uploads.HasThumbnail(id) {
+		res.Thumbnail = res.Url + "/thumb"
+	}
+	LogUpload(r, res)
+	resp.Files = append(resp.Files, res)
+	return true
+}
+
+// uploadFromUrl fetches a file and stores it like an uploaded file
+func uploadFromUrl(r *http.Request, resp *response, rawurl string, opts storage.Options) bool {
+	if !urlUpload {
+		resp.ErrorCode = http.StatusForbidden
+		resp.Description = "uploading from URLs is disabled"
+		return false
+	}
+	body, name, err := fetchUrl(r.Context(), strings.TrimSpace(rawurl))
+	if err != nil {
+		resp.ErrorCode = http.StatusBadGateway
+		resp.Description = err.Error()
+		switch err.(type) {
+		case errFetchForbidden:
+			resp.ErrorCode = http.StatusForbidden
+		case errFetchInvalid:
+			resp.ErrorCode = http.StatusBadRequest
+		case storage.ErrTooLarge:
+			resp.ErrorCode = http.StatusRequestEntityTooLarge
+		}
+		return false
+	}
+	defer body.Close()
+	return store(r, resp, fetchReader{body}, name, opts)
+}
+
 func respond(w http.ResponseWriter, mode string, resp response) {
 	if resp.ErrorCode != 0 {
 		resp.Files = []result{}
@@ -153,21 +372,25 @@ func respond(w http.ResponseWriter, mode string, resp response) {
 	if resp.ErrorCode != 0 {
 		code = resp.ErrorCode
 	}
-	w.WriteHeader(code)
 
 	switch mode {
 	case "json", "":
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
 		json.NewEncoder(w).Encode(resp)
 
 	case "text", "gyazo":
 		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(code)
 		if resp.ErrorCode == 0 {
 			sep := ""
 			for _, file := range resp.Files {
 				io.WriteString(w, sep+file.Url)
 				sep = "\n"
 			}
+			if resp.Album != "" {
+				io.WriteString(w, sep+resp.Album)
+			}
 		} else {
 			io.WriteString(w, "ERROR: ("+strconv.Itoa(resp.ErrorCode)+") "+resp.Description)
 		}
@@ -177,6 +400,7 @@ func respond(w http.ResponseWriter, mode string, resp response) {
 
 	case "csv":
 		w.Header().Set("Content-Type", "text/csv")
+		w.WriteHeader(code)
 		wr := csv.NewWriter(w)
 		if resp.ErrorCode == 0 {
 			wr.Write([]string{"name", "url", "hash", "size"})
@@ -191,6 +415,7 @@ func respond(w http.ResponseWriter, mode string, resp response) {
 
 	case "html":
 		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(code)
 		context := newContext()
 		context.Result = resp
 		if err := templates.ExecuteTemplate(w, "index.html", context); err != nil {
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"git.clsr.net/gomf/storage"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestRawUpload(t *testing.T) {
+	setupTest(t)
+	tests := []struct {
+		method, target string
+		status         int
+		name           string
+	}{
+		{"PUT", "/hello.txt", http.StatusOK, "hello.txt"},
+		{"POST", "/upload?name=hello.txt", http.StatusOK, "hello.txt"},
+		{"POST", "/upload", http.StatusOK, "file"},
+		{"POST", "/upload?name=../../../../../static/evil.html", http.StatusOK, "evil.html"},
+		{"POST", "/upload?name=..", http.StatusOK, "file"},
+		{"PUT", "/dir/..%2F..%2Fevil.html", http.StatusOK, "evil.html"},
+		{"GET", "/upload", http.StatusMethodNotAllowed, ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.target, strings.NewReader("<script>alert(1)</script>"))
+		w := httptest.NewRecorder()
+		handleRawUpload(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s: status %d, want %d: %s", test.method, test.target, w.Code, test.status, w.Body)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		url := strings.TrimSpace(w.Body.String())
+		if !strings.HasPrefix(url, uploadUrl) {
+			t.Errorf("%s %s: unexpected response %q", test.method, test.target, url)
+			continue
+		}
+		f, _, _, _, err := uploads.Get(path.Base(url))
+		if err != nil {
+			t.Errorf("%s %s: %s", test.method, test.target, err)
+			continue
+		}
+		if name := path.Base(f.Name()); name != test.name {
+			t.Errorf("%s %s: stored as %q, want %q", test.method, test.target, name, test.name)
+		}
+		f.Close()
+	}
+}
+
+func TestRawUploadTooLarge(t *testing.T) {
+	setupTest(t)
+	uploads.MaxSize = 10
+	r := httptest.NewRequest("POST", "/upload?name=big.txt&output=json", strings.NewReader(strings.Repeat("x", 100)))
+	w := httptest.NewRecorder()
+	handleRawUpload(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type %q, want application/json", ct)
+	}
+}
+
+func TestServeEncrypted(t *testing.T) {
+	setupTest(t)
+	id, _, _, _, err := uploads.New(strings.NewReader("<html><script>alert(1)</script>"), "page.html", storage.Options{Encrypted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path.Ext(id) != ".bin" {
+		t.Errorf("encrypted upload stored as %q, want a .bin extension", id)
+	}
+	w := httptest.NewRecorder()
+	handleFile(w, httptest.NewRequest("GET", "/"+id, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("Content-Type %q, want application/octet-stream", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, "attachment;") {
+		t.Errorf("Content-Disposition %q, want attachment", cd)
+	}
+}
+
+func TestEncryptedFlag(t *testing.T) {
+	setupTest(t)
+	tests := []struct {
+		value     string
+		encrypted bool
+	}{
+		{"1", true},
+		{"true", true},
+		{"0", false},
+		{"false", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		var results []result
+		r := httptest.NewRequest("POST", "/upload?output=json&name=a.html&encrypted="+test.value, strings.NewReader("<p>raw</p>"))
+		w := httptest.NewRecorder()
+		handleRawUpload(w, r)
+		var resp response
+		json.NewDecoder(w.Body).Decode(&resp)
+		results = append(results, resp.Files...)
+
+		body, ct := multipartBody(t, formField{"encrypted", "", test.value}, formField{"files[]", "b.html", "<p>form</p>"})
+		r = httptest.NewRequest("POST", "/upload.php", body)
+		r.Header.Set("Content-Type", ct)
+		w = httptest.NewRecorder()
+		handleUpload(w, r)
+		resp = response{}
+		json.NewDecoder(w.Body).Decode(&resp)
+		results = append(results, resp.Files...)
+
+		if len(results) != 2 {
+			t.Fatalf("encrypted=%q: uploaded %+v", test.value, results)
+		}
+		for _, res := range results {
+			if res.Encrypted != test.encrypted || (path.Ext(res.Url) == ".bin") != test.encrypted {
+				t.Errorf("encrypted=%q: uploaded %+v", test.value, res)
+			}
+		}
+	}
+}
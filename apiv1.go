@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"git.clsr.net/gomf/storage"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the versioned API is described by apiRoutes, which is used both to route
+// requests and to generate the OpenAPI document at /api/v1/openapi.json
+
+const (
+	apiPrefix       = "/api/v1"
+	apiDefaultLimit = 100
+	apiMaxLimit     = 1000
+)
+
+type apiParam struct {
+	Name        string
+	In          string // "path", "query" or "form"
+	Type        string // "string", "integer", "boolean" or "file"
+	Array       bool
+	Required    bool
+	Description string
+}
+
+type apiRoute struct {
+	Method  string
+	Path    string // relative to apiPrefix; {id} matches one path element
+	Summary string
+	Admin   bool
+	Params  []apiParam
+	// Result is a value of the type of the JSON response
+	Result  interface{}
+	handler func(w http.ResponseWriter, r *http.Request, id string)
+}
+
+type fileList struct {
+	Files []fileInfo `json:"files"`
+	// Errors lists files that could not be read, as "ID: error"
+	Errors []string `json:"errors,omitempty"`
+}
+
+var apiRoutes []apiRoute
+
+func init() {
+	idParam := apiParam{Name: "id", In: "path", Type: "string", Required: true, Description: "file ID with extension"}
+	apiRoutes = []apiRoute{
+		{
+			Method:  http.MethodPost,
+			Path:    "/upload",
+			Summary: "Upload files; the Pomf-compatible /upload.php also accepts other output formats",
+			Params: []apiParam{
+				{Name: "files[]", In: "form", Type: "file", Array: true, Description: "files to upload"},
+				{Name: "url", In: "form", Type: "string", Array: true, Description: "URLs to fetch and store, if enabled"},
+				{Name: "encrypted", In: "form", Type: "boolean", Description: "the files are encrypted by the client"},
+				{Name: "strip", In: "form", Type: "boolean", Description: "strip metadata from images"},
+				{Name: "album", In: "form", Type: "boolean", Description: "group the files into an album"},
+			},
+			Result:  response{},
+			handler: apiUpload,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/files",
+			Summary: "List uploaded files, newest first",
+			Admin:   true,
+			Params: []apiParam{
+				{Name: "since", In: "query", Type: "string", Description: "only files uploaded after this duration ago (e.g. 24h), date or RFC 3339 time"},
+				{Name: "limit", In: "query", Type: "integer", Description: "maximum number of files, " + strconv.Itoa(apiDefaultLimit) + " by default and at most " + strconv.Itoa(apiMaxLimit)},
+			},
+			Result:  fileList{},
+			handler: apiList,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/files/{id}",
+			Summary: "Get information about a file",
+			Params:  []apiParam{idParam},
+			Result:  fileInfo{},
+			handler: func(w http.ResponseWriter, r *http.Request, id string) { writeFileInfo(w, id) },
+		},
+		{
+			Method:  http.MethodDelete,
+			Path:    "/files/{id}",
+			Summary: "Remove a file ID, and the stored file if no other IDs refer to it",
+			Admin:   true,
+			Params:  []apiParam{idParam},
+			Result:  response{},
+			handler: apiDelete,
+		},
+		{
+			Method:  http.MethodGet,
+			Path:    "/openapi.json",
+			Summary: "This OpenAPI document",
+			handler: handleOpenAPI,
+		},
+	}
+}
+
+func apiError(w http.ResponseWriter, code int, description string) {
+	respond(w, "json", response{ErrorCode: code, Description: description})
+}
+
+// match reports whether path matches the route path and returns the value
+// of its {id} element
+func (route apiRoute) match(path string) (id string, ok bool) {
+	want := strings.Split(route.Path, "/")
+	got := strings.Split(path, "/")
+	if len(want) != len(got) {
+		return "", false
+	}
+	for i := range want {
+		if want[i] == "{id}" && got[i] != "" {
+			id = got[i]
+		} else if want[i] != got[i] {
+			return "", false
+		}
+	}
+	return id, true
+}
+
+func handleApi(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, apiPrefix)
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	allow := []string{}
+	for _, route := range apiRoutes {
+		id, ok := route.match(path)
+		if !ok {
+			continue
+		}
+		if route.Method != method {
+			allow = append(allow, route.Method)
+			continue
+		}
+		if route.Admin && !isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			apiError(w, http.StatusUnauthorized, "this endpoint requires the admin key")
+			return
+		}
+		route.handler(w, r, id)
+		return
+	}
+	if len(allow) > 0 {
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		apiError(w, http.StatusMethodNotAllowed, "The method is not allowed for the requested URL.")
+		return
+	}
+	apiError(w, http.StatusNotFound, "unknown API endpoint "+r.URL.Path)
+}
+
+func apiUpload(w http.ResponseWriter, r *http.Request, id string) {
+	// always respond with JSON
+	q := r.URL.Query()
+	q.Del("output")
+	r.URL.RawQuery = q.Encode()
+	handleUpload(w, r)
+}
+
+func apiDelete(w http.ResponseWriter, r *http.Request, id string) {
+	err := uploads.Remove(id)
+	LogAdmin(r, "delete", id, err)
+	if err != nil {
+		apiError(w, storageErrorCode(err), err.Error())
+		return
+	}
+	respond(w, "json", response{})
+}
+
+func apiList(w http.ResponseWriter, r *http.Request, id string) {
+	limit := apiDefaultLimit
+	if v := r.FormValue("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			apiError(w, http.StatusBadRequest, "invalid limit "+v)
+			return
+		}
+		limit = n
+	}
+	if limit > apiMaxLimit {
+		limit = apiMaxLimit
+	}
+	var since time.Time
+	if v := r.FormValue("since"); v != "" {
+		var err error
+		if since, err = parseTime(v); err != nil {
+			apiError(w, http.StatusBadRequest, "invalid time "+v)
+			return
+		}
+	}
+
+	infos := []*storage.Info{}
+	list := fileList{Files: []fileInfo{}}
+	err := uploads.Walk(false, func(info *storage.Info) error {
+		if info.Time.After(since) {
+			infos = append(infos, info)
+		}
+		return nil
+	}, func(id string, err error) {
+		list.Errors = append(list.Errors, id+": "+err.Error())
+	})
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Time.After(infos[j].Time) })
+	if len(infos) > limit {
+		infos = infos[:limit]
+	}
+	sort.Strings(list.Errors)
+	for _, info := range infos {
+		list.Files = append(list.Files, newFileInfo(info))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request, id string) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(openAPIDocument())
+}
+
+type object = map[string]interface{}
+
+// openAPIDocument describes apiRoutes as an OpenAPI 3 document; response
+// schemas are derived from the JSON encoding of the route result types
+func openAPIDocument() object {
+	schemas := object{}
+	paths := object{}
+	for _, route := range apiRoutes {
+		op := object{
+			"summary":     route.Summary,
+			"operationId": operationId(route),
+		}
+		params := []object{}
+		form := object{}
+		required := []string{}
+		for _, p := range route.Params {
+			schema := paramSchema(p)
+			if p.In == "form" {
+				form[p.Name] = schema
+				if p.Required {
+					required = append(required, p.Name)
+				}
+				continue
+			}
+			params = append(params, object{
+				"name":        p.Name,
+				"in":          p.In,
+				"required":    p.Required,
+				"description": p.Description,
+				"schema":      schema,
+			})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if len(form) > 0 {
+			body := object{"type": "object", "properties": form}
+			if len(required) > 0 {
+				body["required"] = required
+			}
+			op["requestBody"] = object{
+				"required": true,
+				"content":  object{"multipart/form-data": object{"schema": body}},
+			}
+		}
+		if route.Admin {
+			op["security"] = []object{{"adminKey": []string{}}}
+		}
+		ok := object{"description": "success"}
+		if route.Result != nil {
+			ok["content"] = object{"application/json": object{"schema": typeSchema(reflect.TypeOf(route.Result), schemas)}}
+		} else {
+			ok["content"] = object{"application/json": object{"schema": object{"type": "object"}}}
+		}
+		op["responses"] = object{
+			"200":     ok,
+			"default": object{"description": "error", "content": object{"application/json": object{"schema": typeSchema(reflect.TypeOf(response{}), schemas)}}},
+		}
+
+		item, _ := paths[route.Path].(object)
+		if item == nil {
+			item = object{}
+			paths[route.Path] = item
+		}
+		item[strings.ToLower(route.Method)] = op
+	}
+
+	return object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":   siteName + " API",
+			"version": "1",
+		},
+		"servers": []object{{"url": apiPrefix}},
+		"paths":   paths,
+		"components": object{
+			"schemas": schemas,
+			"securitySchemes": object{
+				"adminKey": object{"type": "http", "scheme": "bearer", "description": "the key in -admin-key-file"},
+			},
+		},
+	}
+}
+
+func operationId(route apiRoute) string {
+	name := strings.ToLower(route.Method)
+	for _, part := range strings.Split(route.Path, "/") {
+		part = strings.Trim(part, "{}")
+		if i := strings.IndexByte(part, '.'); i >= 0 {
+			part = part[:i]
+		}
+		if part != "" {
+			name += strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return name
+}
+
+func paramSchema(p apiParam) object {
+	schema := object{"type": p.Type}
+	if p.Type == "file" {
+		schema = object{"type": "string", "format": "binary"}
+	}
+	if p.Array {
+		schema = object{"type": "array", "items": schema}
+	}
+	if p.Description != "" && p.In == "form" {
+		schema["description"] = p.Description
+	}
+	return schema
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// typeSchema returns the JSON schema of a type as encoded by encoding/json;
+// named struct types are added to schemas and referenced
+func typeSchema(t reflect.Type, schemas object) object {
+	nullable := false
+	if t.Kind() == reflect.Ptr {
+		t, nullable = t.Elem(), true
+	}
+	var schema object
+	switch {
+	case t == timeType:
+		schema = object{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.String:
+		schema = object{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		schema = object{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		schema = object{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		schema = object{"type": "number"}
+	case t.Kind() == reflect.Slice:
+		schema = object{"type": "array", "items": typeSchema(t.Elem(), schemas)}
+	case t.Kind() == reflect.Struct:
+		name := t.Name()
+		if name != "" {
+			name = strings.ToUpper(name[:1]) + name[1:]
+			if _, ok := schemas[name]; !ok {
+				schemas[name] = object{} // placeholder for recursive types
+				schemas[name] = structSchema(t, schemas)
+			}
+			schema = object{"$ref": "#/components/schemas/" + name}
+		} else {
+			schema = structSchema(t, schemas)
+		}
+	default:
+		schema = object{}
+	}
+	if nullable {
+		if _, ok := schema["$ref"]; ok {
+			schema = object{"allOf": []object{schema}, "nullable": true}
+		} else {
+			schema["nullable"] = true
+		}
+	}
+	return schema
+}
+
+func structSchema(t reflect.Type, schemas object) object {
+	props := object{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = typeSchema(f.Type, schemas)
+		omitempty := false
+		for _, opt := range tag[1:] {
+			omitempty = omitempty || opt == "omitempty"
+		}
+		if !omitempty {
+			required = append(required, name)
+		}
+	}
+	schema := object{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"git.clsr.net/gomf/storage"
+	"image"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testAdminKey = "test-admin-key"
+
+var registerApi sync.Once
+
+// setupApiTest prepares the global state for requests to the API through
+// handle, like main does
+func setupApiTest(t *testing.T) string {
+	dir := setupTest(t)
+	registerApi.Do(func() { http.HandleFunc(apiPrefix+"/", handleApi) })
+	albumUrl = "http://example.com/a/"
+	oldKey := adminKey
+	adminKey = testAdminKey
+	t.Cleanup(func() { adminKey = oldKey })
+	return dir
+}
+
+type formField struct {
+	name, filename, value string
+}
+
+func multipartBody(t *testing.T, fields ...formField) (io.Reader, string) {
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	for _, f := range fields {
+		var w io.Writer
+		var err error
+		if f.filename != "" {
+			w, err = mw.CreateFormFile(f.name, f.filename)
+		} else {
+			w, err = mw.CreateFormField(f.name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, f.value)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf, mw.FormDataContentType()
+}
+
+func apiRequest(method, target string, body io.Reader, contentType string, admin bool) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, body)
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	if admin {
+		r.Header.Set("Authorization", "Bearer "+testAdminKey)
+	}
+	w := httptest.NewRecorder()
+	handle(w, r)
+	return w
+}
+
+func apiUploadFiles(t *testing.T, fields ...formField) response {
+	body, ct := multipartBody(t, fields...)
+	w := apiRequest("POST", apiPrefix+"/upload", body, ct, false)
+	var resp response
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("upload: %s", err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload: status %d: %+v", w.Code, resp)
+	}
+	return resp
+}
+
+func apiUploadId(t *testing.T, name, contents string) string {
+	resp := apiUploadFiles(t, formField{"files[]", name, contents})
+	if len(resp.Files) != 1 {
+		t.Fatalf("upload of %s returned %d files", name, len(resp.Files))
+	}
+	return path.Base(resp.Files[0].Url)
+}
+
+func listFiles(t *testing.T, query string) fileList {
+	w := apiRequest("GET", apiPrefix+"/files"+query, nil, "", true)
+	var list fileList
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("GET /files%s: status %d, %v", query, w.Code, err)
+	}
+	return list
+}
+
+func getDocument(t *testing.T) object {
+	w := apiRequest("GET", apiPrefix+"/openapi.json", nil, "", false)
+	if w.Code != http.StatusOK {
+		t.Fatalf("openapi.json: status %d", w.Code)
+	}
+	var doc object
+	if err := json.NewDecoder(w.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// checkSchema reports values that do not match a schema of the document
+func checkSchema(t *testing.T, doc, schema object, v interface{}, where string) {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		schema = doc["components"].(object)["schemas"].(object)[name].(object)
+	}
+	if v == nil && schema["nullable"] == true {
+		return
+	}
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, s := range all {
+			checkSchema(t, doc, s.(object), v, where)
+		}
+		return
+	}
+	switch schema["type"] {
+	case "object":
+		m, ok := v.(object)
+		if !ok {
+			t.Errorf("%s: %v is not an object", where, v)
+			return
+		}
+		props, _ := schema["properties"].(object)
+		if props == nil {
+			return
+		}
+		for k, pv := range m {
+			ps, ok := props[k].(object)
+			if !ok {
+				t.Errorf("%s: undocumented property %q", where, k)
+				continue
+			}
+			checkSchema(t, doc, ps, pv, where+"."+k)
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, k := range required {
+			if _, ok := m[k.(string)]; !ok {
+				t.Errorf("%s: missing required property %q", where, k)
+			}
+		}
+	case "array":
+		a, ok := v.([]interface{})
+		if !ok {
+			t.Errorf("%s: %v is not an array", where, v)
+			return
+		}
+		for i, e := range a {
+			checkSchema(t, doc, schema["items"].(object), e, fmt.Sprintf("%s[%d]", where, i))
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			t.Errorf("%s: %v is not a string", where, v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			t.Errorf("%s: %v is not a boolean", where, v)
+		}
+	case "integer":
+		if f, ok := v.(float64); !ok || f != float64(int64(f)) {
+			t.Errorf("%s: %v is not an integer", where, v)
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			t.Errorf("%s: %v is not a number", where, v)
+		}
+	}
+}
+
+func checkResponse(t *testing.T, doc, op object, w *httptest.ResponseRecorder, status int, where string) {
+	if w.Code != status {
+		t.Errorf("%s: status %d, want %d: %s", where, w.Code, status, w.Body)
+		return
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s: Content-Type %q, want application/json", where, ct)
+	}
+	var v interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Errorf("%s: invalid JSON: %s", where, err)
+		return
+	}
+	key := "default"
+	if status == http.StatusOK {
+		key = "200"
+	}
+	schema := op["responses"].(object)[key].(object)["content"].(object)["application/json"].(object)["schema"].(object)
+	checkSchema(t, doc, schema, v, where)
+	if status != http.StatusOK {
+		checkError(t, w, status, where)
+	}
+}
+
+// checkError checks that a response is a JSON error like those of the
+// Pomf-compatible upload API
+func checkError(t *testing.T, w *httptest.ResponseRecorder, status int, where string) {
+	var resp response
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Errorf("%s: invalid error JSON: %s", where, err)
+		return
+	}
+	if w.Code != status || resp.Success || resp.ErrorCode != status || resp.Description == "" {
+		t.Errorf("%s: status %d, error %+v, want errorcode %d with a description", where, w.Code, resp, status)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%s: Content-Type %q, want application/json", where, ct)
+	}
+}
+
+// documentedOps returns the operations of the document as "METHOD path"
+func documentedOps(doc object) map[string]object {
+	ops := map[string]object{}
+	for p, item := range doc["paths"].(object) {
+		for method, op := range item.(object) {
+			ops[strings.ToUpper(method)+" "+p] = op.(object)
+		}
+	}
+	return ops
+}
+
+func TestApiRoutes(t *testing.T) {
+	setupApiTest(t)
+	doc := getDocument(t)
+	ops := documentedOps(doc)
+	if len(ops) != len(apiRoutes) {
+		t.Errorf("document has %d operations, want %d", len(ops), len(apiRoutes))
+	}
+
+	for name, op := range ops {
+		parts := strings.SplitN(name, " ", 2)
+		method, p := parts[0], parts[1]
+		target := apiPrefix + strings.Replace(p, "{id}", apiUploadId(t, "a.txt", name), 1)
+		var body io.Reader
+		ct := ""
+		if method == "POST" {
+			body, ct = multipartBody(t, formField{"files[]", "a.txt", "contents"})
+		}
+		_, admin := op["security"]
+		if admin {
+			w := apiRequest(method, target, nil, "", false)
+			checkResponse(t, doc, op, w, http.StatusUnauthorized, name+" without key")
+			if w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("%s without key: no WWW-Authenticate header", name)
+			}
+		}
+		checkResponse(t, doc, op, apiRequest(method, target, body, ct, admin), http.StatusOK, name)
+		if strings.Contains(p, "{id}") {
+			w := apiRequest(method, apiPrefix+strings.Replace(p, "{id}", "missing.txt", 1), nil, "", true)
+			checkResponse(t, doc, op, w, http.StatusNotFound, name+" of a missing file")
+		}
+	}
+
+	// methods that are not documented for a path are rejected
+	for p, item := range doc["paths"].(object) {
+		allowed := []string{}
+		for method := range item.(object) {
+			allowed = append(allowed, strings.ToUpper(method))
+		}
+		sort.Strings(allowed)
+		for _, method := range []string{"GET", "POST", "PUT", "DELETE"} {
+			if _, ok := item.(object)[strings.ToLower(method)]; ok {
+				continue
+			}
+			w := apiRequest(method, apiPrefix+strings.Replace(p, "{id}", "a.txt", 1), nil, "", true)
+			checkError(t, w, http.StatusMethodNotAllowed, method+" "+p)
+			got := strings.Split(w.Header().Get("Allow"), ", ")
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(allowed, ",") {
+				t.Errorf("%s %s: Allow %v, want %v", method, p, got, allowed)
+			}
+		}
+	}
+
+	checkError(t, apiRequest("GET", apiPrefix+"/nothing", nil, "", true), http.StatusNotFound, "unknown path")
+}
+
+func testJpegWithGps(t *testing.T) string {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	// EXIF with a GPS IFD pointer tag
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x01\x88\x25\x00\x04\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+	seg := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(exif)+2))
+	img := buf.Bytes()
+	return string(img[:2]) + string(seg) + string(exif) + string(img[2:])
+}
+
+// apiParamTests checks that every documented parameter changes the result
+// of its operation
+var apiParamTests = map[string]func(t *testing.T){
+	"POST /upload files[]": func(t *testing.T) {
+		if resp := apiUploadFiles(t); len(resp.Files) != 0 {
+			t.Errorf("upload without files returned %d files", len(resp.Files))
+		}
+		resp := apiUploadFiles(t, formField{"files[]", "a.txt", "a"}, formField{"files[]", "b.txt", "b"})
+		if len(resp.Files) != 2 || resp.Files[0].Name != "a.txt" || resp.Files[1].Name != "b.txt" {
+			t.Errorf("upload of two files returned %+v", resp.Files)
+		}
+	},
+	"POST /upload url": func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "fetched contents")
+		}))
+		defer srv.Close()
+		oldUpload, oldPrivate := urlUpload, fetchPrivate
+		urlUpload, fetchPrivate = true, true
+		defer func() { urlUpload, fetchPrivate = oldUpload, oldPrivate }()
+		resp := apiUploadFiles(t, formField{"url", "", srv.URL + "/fetched.txt"})
+		if len(resp.Files) != 1 || resp.Files[0].Name != "fetched.txt" || resp.Files[0].Size != 16 {
+			t.Errorf("URL upload returned %+v", resp.Files)
+		}
+	},
+	"POST /upload encrypted": func(t *testing.T) {
+		plain := apiUploadFiles(t, formField{"files[]", "a.html", "<p>a</p>"})
+		enc := apiUploadFiles(t, formField{"encrypted", "", "1"}, formField{"files[]", "a.html", "<p>b</p>"})
+		if plain.Files[0].Encrypted || path.Ext(plain.Files[0].Url) != ".html" {
+			t.Errorf("plain upload returned %+v", plain.Files[0])
+		}
+		if !enc.Files[0].Encrypted || path.Ext(enc.Files[0].Url) != ".bin" {
+			t.Errorf("encrypted upload returned %+v", enc.Files[0])
+		}
+	},
+	"POST /upload strip": func(t *testing.T) {
+		img := testJpegWithGps(t)
+		kept := apiUploadFiles(t, formField{"strip", "", "0"}, formField{"files[]", "a.jpg", img})
+		stripped := apiUploadFiles(t, formField{"strip", "", "1"}, formField{"files[]", "b.jpg", img})
+		if kept.Files[0].Stripped || kept.Files[0].Size != int64(len(img)) {
+			t.Errorf("upload with strip=0 returned %+v", kept.Files[0])
+		}
+		if !stripped.Files[0].Stripped || stripped.Files[0].Size >= int64(len(img)) {
+			t.Errorf("upload with strip=1 returned %+v", stripped.Files[0])
+		}
+	},
+	"POST /upload album": func(t *testing.T) {
+		if resp := apiUploadFiles(t, formField{"files[]", "a.txt", "a"}); resp.Album != "" {
+			t.Errorf("upload without album returned album %q", resp.Album)
+		}
+		resp := apiUploadFiles(t, formField{"album", "", "1"}, formField{"files[]", "a.txt", "a"}, formField{"files[]", "b.txt", "b"})
+		if !strings.HasPrefix(resp.Album, albumUrl) {
+			t.Fatalf("upload with album returned album %q", resp.Album)
+		}
+		album, err := uploads.GetAlbum(path.Base(resp.Album))
+		if err != nil || len(album.Ids) != 2 {
+			t.Errorf("album %s: %+v, %v", resp.Album, album, err)
+		}
+	},
+	"GET /files since": func(t *testing.T) {
+		apiUploadId(t, "a.txt", "a")
+		if n := len(listFiles(t, "").Files); n != 1 {
+			t.Errorf("list returned %d files, want 1", n)
+		}
+		future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+		if n := len(listFiles(t, "?since="+future).Files); n != 0 {
+			t.Errorf("list since %s returned %d files, want 0", future, n)
+		}
+		checkError(t, apiRequest("GET", apiPrefix+"/files?since=never", nil, "", true), http.StatusBadRequest, "invalid since")
+	},
+	"GET /files limit": func(t *testing.T) {
+		apiUploadId(t, "a.txt", "a")
+		apiUploadId(t, "b.txt", "b")
+		if n := len(listFiles(t, "").Files); n != 2 {
+			t.Errorf("list returned %d files, want 2", n)
+		}
+		if n := len(listFiles(t, "?limit=1").Files); n != 1 {
+			t.Errorf("list with limit=1 returned %d files, want 1", n)
+		}
+		checkError(t, apiRequest("GET", apiPrefix+"/files?limit=x", nil, "", true), http.StatusBadRequest, "invalid limit")
+	},
+	"GET /files/{id} id": func(t *testing.T) {
+		for _, name := range []string{"a.txt", "b.txt"} {
+			id := apiUploadId(t, name, name)
+			w := apiRequest("GET", apiPrefix+"/files/"+id, nil, "", false)
+			var info fileInfo
+			if err := json.NewDecoder(w.Body).Decode(&info); err != nil || info.Id != id || info.Name != name {
+				t.Errorf("GET /files/%s returned %+v, %v", id, info, err)
+			}
+		}
+	},
+	"DELETE /files/{id} id": func(t *testing.T) {
+		a, b := apiUploadId(t, "a.txt", "a"), apiUploadId(t, "b.txt", "b")
+		if w := apiRequest("DELETE", apiPrefix+"/files/"+a, nil, "", true); w.Code != http.StatusOK {
+			t.Fatalf("DELETE /files/%s: status %d", a, w.Code)
+		}
+		if _, err := uploads.FileInfo(a); err == nil {
+			t.Errorf("%s was not removed", a)
+		}
+		if _, err := uploads.FileInfo(b); err != nil {
+			t.Errorf("%s was removed: %s", b, err)
+		}
+	},
+}
+
+func TestApiParams(t *testing.T) {
+	setupApiTest(t)
+	documented := map[string]bool{}
+	for name, op := range documentedOps(getDocument(t)) {
+		params, _ := op["parameters"].([]interface{})
+		for _, p := range params {
+			documented[name+" "+p.(object)["name"].(string)] = true
+		}
+		if body, ok := op["requestBody"].(object); ok {
+			schema := body["content"].(object)["multipart/form-data"].(object)["schema"].(object)
+			for p := range schema["properties"].(object) {
+				documented[name+" "+p] = true
+			}
+		}
+	}
+	for param := range documented {
+		if apiParamTests[param] == nil {
+			t.Errorf("documented parameter %s is not tested", param)
+		}
+	}
+	for param, test := range apiParamTests {
+		if !documented[param] {
+			t.Errorf("tested parameter %s is not documented", param)
+			continue
+		}
+		t.Run(param, func(t *testing.T) {
+			setupApiTest(t)
+			test(t)
+		})
+	}
+}
+
+func TestApiListUnreadable(t *testing.T) {
+	dir := setupApiTest(t)
+	keyring := func(key string) *storage.Keyring {
+		fname := path.Join(dir, "key")
+		if err := ioutil.WriteFile(fname, []byte(strings.Repeat(key, 64)+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		k, err := storage.LoadKeyring(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	uploads.Keys = keyring("1")
+	lost := apiUploadId(t, "lost.txt", "lost")
+	uploads.Keys = keyring("2")
+	kept := apiUploadId(t, "kept.txt", "kept")
+
+	list := listFiles(t, "")
+	if len(list.Files) != 1 || list.Files[0].Id != kept {
+		t.Errorf("list returned %+v, want only %s", list.Files, kept)
+	}
+	if len(list.Errors) != 1 || !strings.HasPrefix(list.Errors[0], lost+": ") {
+		t.Errorf("list errors = %q, want one for %s", list.Errors, lost)
+	}
+}
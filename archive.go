@@ -0,0 +1,159 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	archiveMaxSize  int64 = 1 << 30
+	archiveMaxFiles       = 1000
+)
+
+// archiveNames gives each file in an archive a unique name based on its
+// original filename
+type archiveNames map[string]bool
+
+func (names archiveNames) unique(name string) string {
+	name = path.Base(name)
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; names[name]; i++ {
+		name = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+	names[name] = true
+	return name
+}
+
+// archiveWriter adds files to a zip or tar archive
+type archiveWriter interface {
+	add(name string, size int64, modtime time.Time, r io.Reader) error
+	Close() error
+}
+
+type zipArchive struct{ *zip.Writer }
+
+func (z zipArchive) add(name string, size int64, modtime time.Time, r io.Reader) error {
+	hdr := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modtime}
+	fw, err := z.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+type tarArchive struct{ *tar.Writer }
+
+func (t tarArchive) add(name string, size int64, modtime time.Time, r io.Reader) error {
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modtime, Typeflag: tar.TypeReg}
+	if err := t.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.CopyN(t, r, size)
+	return err
+}
+
+// handleArchive streams the files given as id parameters (repeated or
+// comma-separated) or the files of an album as a zip or tar archive
+func handleArchive(w http.ResponseWriter, r *http.Request) {
+	format := r.FormValue("format")
+	if format == "" {
+		format = "zip"
+	}
+	if albumId := r.FormValue("album"); albumId != "" {
+		album, err := uploads.GetAlbum(albumId)
+		if err != nil {
+			storageError(w, err)
+			return
+		}
+		writeArchive(w, album.Ids, true, format, albumId)
+		return
+	}
+	ids := []string{}
+	for _, v := range r.Form["id"] {
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		http.Error(w, "no files given", http.StatusBadRequest)
+		return
+	}
+	writeArchive(w, ids, false, format, "files")
+}
+
+// writeArchive streams the uploaded files with the given IDs as an archive
+// named name in the given format; files that are missing or disabled cause
+// an error unless skipMissing is set
+func writeArchive(w http.ResponseWriter, ids []string, skipMissing bool, format, name string) {
+	if format != "zip" && format != "tar" {
+		http.Error(w, "invalid archive format "+format, http.StatusBadRequest)
+		return
+	}
+	if len(ids) > archiveMaxFiles {
+		http.Error(w, "too many files; the limit is "+strconv.Itoa(archiveMaxFiles), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// the size is checked before anything is sent, since an error cannot be
+	// reported once the archive has started
+	found := []string{}
+	var total int64
+	for _, id := range ids {
+		f, _, size, _, err := uploads.Get(id)
+		if err != nil {
+			if skipMissing {
+				continue
+			}
+			storageError(w, err)
+			return
+		}
+		f.Close()
+		total += size
+		found = append(found, id)
+	}
+	if archiveMaxSize > 0 && total > archiveMaxSize {
+		http.Error(w, "the files are too large to download as an archive; the limit is "+humanize(archiveMaxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var aw archiveWriter
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		aw = zipArchive{zip.NewWriter(w)}
+	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+		aw = tarArchive{tar.NewWriter(w)}
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"."+format+"\"")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	names := archiveNames{}
+	for _, id := range found {
+		f, _, size, modtime, err := uploads.Get(id)
+		if err != nil {
+			// removed since the check; nothing of its entry was written yet
+			fmt.Fprintf(os.Stderr, "archive %s: %s\n", id, err)
+			continue
+		}
+		err = aw.add(names.unique(f.Name()), size, modtime, f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "archive %s: %s\n", id, err)
+			// a partial entry corrupts the archive, so the response is
+			// aborted instead of being completed
+			panic(http.ErrAbortHandler)
+		}
+	}
+	aw.Close()
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"git.clsr.net/gomf/storage"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestArchiveNames(t *testing.T) {
+	names := archiveNames{}
+	tests := []struct {
+		name, want string
+	}{
+		{"a.txt", "a.txt"},
+		{"a.txt", "a (2).txt"},
+		{"a (3).txt", "a (3).txt"},
+		{"a.txt", "a (4).txt"},
+		{"../../etc/a.txt", "a (5).txt"},
+		{"README", "README"},
+		{"README", "README (2)"},
+		{"archive.tar.gz", "archive.tar.gz"},
+		{"archive.tar.gz", "archive.tar (2).gz"},
+	}
+	for _, test := range tests {
+		if got := names.unique(test.name); got != test.want {
+			t.Errorf("unique(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// readArchive returns the names and contents of the files in an archive
+func readArchive(t *testing.T, format string, data []byte) ([]string, map[string]string) {
+	var names []string
+	files := make(map[string]string)
+	switch format {
+	case "zip":
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("invalid zip: %s", err)
+		}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatalf("%s: %s", f.Name, err)
+			}
+			names = append(names, f.Name)
+			files[f.Name] = string(contents)
+		}
+	case "tar":
+		tr := tar.NewReader(bytes.NewReader(data))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("invalid tar: %s", err)
+			}
+			contents, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatalf("%s: %s", hdr.Name, err)
+			}
+			names = append(names, hdr.Name)
+			files[hdr.Name] = string(contents)
+		}
+	}
+	return names, files
+}
+
+func TestArchive(t *testing.T) {
+	setupTest(t)
+	// one file is stored compressed, so the archive holds the decompressed
+	// contents and sizes
+	uploads.CompressMin = 1
+	uploads.CompressMime = []string{"text/"}
+	long := strings.Repeat("compressible text\n", 1000)
+	uploadFiles := []struct{ name, contents string }{
+		{"a.txt", "first"},
+		{"a.txt", "second"},
+		{"b.txt", long},
+	}
+	var ids []string
+	for _, f := range uploadFiles {
+		id, _, _, _, err := uploads.New(strings.NewReader(f.contents), f.name, storage.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if f, _, _, _, err := uploads.Get(ids[2]); err != nil || f.Gzip() == nil {
+		t.Fatalf("b.txt is not stored compressed (%v)", err)
+	} else {
+		f.Close()
+	}
+	album, err := uploads.NewAlbum(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantNames := []string{"a.txt", "a (2).txt", "b.txt"}
+	wantFiles := map[string]string{"a.txt": "first", "a (2).txt": "second", "b.txt": long}
+
+	archive := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleArchive(w, httptest.NewRequest("GET", "/archive?"+query, nil))
+		return w
+	}
+	for _, format := range []string{"zip", "tar"} {
+		for _, query := range []string{
+			"id=" + strings.Join(ids, ",") + "&format=" + format,
+			"id=" + ids[0] + "&id=" + ids[1] + "," + ids[2] + "&format=" + format,
+			"album=" + album + "&format=" + format,
+		} {
+			w := archive(query)
+			if w.Code != http.StatusOK {
+				t.Errorf("%s: status %d: %s", query, w.Code, w.Body)
+				continue
+			}
+			if cd := w.Header().Get("Content-Disposition"); !strings.HasSuffix(cd, "."+format+"\"") {
+				t.Errorf("%s: Content-Disposition %q", query, cd)
+			}
+			names, files := readArchive(t, format, w.Body.Bytes())
+			if !reflect.DeepEqual(names, wantNames) || !reflect.DeepEqual(files, wantFiles) {
+				t.Errorf("%s: archive contains %q", query, names)
+			}
+		}
+	}
+	if names, _ := readArchive(t, "zip", archive("id="+ids[0]).Body.Bytes()); !reflect.DeepEqual(names, []string{"a.txt"}) {
+		t.Errorf("default format: archive contains %q", names)
+	}
+
+	// files removed from an album are skipped, but missing files that were
+	// asked for by ID are an error
+	if err = uploads.Remove(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	names, _ := readArchive(t, "zip", archive("album="+album).Body.Bytes())
+	if !reflect.DeepEqual(names, []string{"a.txt", "b.txt"}) {
+		t.Errorf("album with a removed file: archive contains %q", names)
+	}
+	ids = append(ids[:1], ids[2:]...)
+
+	errorTests := []struct {
+		query  string
+		status int
+	}{
+		{"", http.StatusBadRequest},
+		{"id=" + ids[0] + "&format=rar", http.StatusBadRequest},
+		{"id=" + ids[0] + ",zzzzzz", http.StatusNotFound},
+		{"album=zzzzzz", http.StatusNotFound},
+	}
+	for _, test := range errorTests {
+		if w := archive(test.query); w.Code != test.status {
+			t.Errorf("%q: status %d, want %d", test.query, w.Code, test.status)
+		}
+	}
+
+	oldSize, oldFiles := archiveMaxSize, archiveMaxFiles
+	defer func() { archiveMaxSize, archiveMaxFiles = oldSize, oldFiles }()
+	archiveMaxFiles = 1
+	if w := archive("id=" + strings.Join(ids, ",")); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("more than archiveMaxFiles: status %d", w.Code)
+	}
+	archiveMaxFiles = 10
+	// the limit applies to the uncompressed size
+	archiveMaxSize = int64(len(long))
+	if w := archive("id=" + strings.Join(ids, ",")); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("more than archiveMaxSize: status %d", w.Code)
+	}
+	if w := archive("id=" + ids[1]); w.Code != http.StatusOK {
+		t.Errorf("exactly archiveMaxSize: status %d", w.Code)
+	}
+}
+
+func TestArchiveCopyError(t *testing.T) {
+	dir := setupTest(t)
+	keyfile := path.Join(dir, "keys")
+	if err := ioutil.WriteFile(keyfile, []byte(strings.Repeat("ab", 32)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := storage.LoadKeyring(keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads.Keys = keys
+	good, _, _, _, err := uploads.New(strings.NewReader("intact"), "good.txt", storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, _, _, _, err := uploads.New(strings.NewReader(strings.Repeat("x", 200*1024)), "bad.txt", storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// corrupt a later chunk of the larger blob, so reading it fails after
+	// its entry was started
+	filepath.Walk(path.Join(uploads.Folder, "files"), func(fpath string, info os.FileInfo, err error) error {
+		if err == nil && info.Name() == "file" && info.Size() > 100*1024 {
+			f, err := os.OpenFile(fpath, os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteAt([]byte("corrupt"), info.Size()-100)
+			f.Close()
+		}
+		return nil
+	})
+
+	for _, format := range []string{"zip", "tar"} {
+		func() {
+			defer func() {
+				if p := recover(); p != http.ErrAbortHandler {
+					t.Errorf("%s: got panic %v, want http.ErrAbortHandler", format, p)
+				}
+			}()
+			w := httptest.NewRecorder()
+			handleArchive(w, httptest.NewRequest("GET", "/archive?format="+format+"&id="+good+","+bad, nil))
+		}()
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"git.clsr.net/gomf/storage"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	adminMaxFiles      = 100
+	adminMaxLogEntries = 500
+	// adminLinksMaxAge is how long the walked list of uploads is reused for
+	// listing and searching them
+	adminLinksMaxAge = time.Minute
+	csrfCookie       = "gomf_csrf"
+)
+
+var (
+	adminKey   string
+	csrfSecret = make([]byte, 32)
+
+	adminLinksLock    sync.Mutex
+	adminLinks        []*storage.Info
+	adminLinksTime    time.Time
+	adminLinksStorage *storage.Storage
+)
+
+func init() {
+	builtinPages["_admin.html"] = adminPage
+	builtinPages["_admin-logs.html"] = adminLogsPage
+	rand.Read(csrfSecret)
+}
+
+func loadAdminKey(fname string) error {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+	adminKey = strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0])
+	if adminKey == "" {
+		return errors.New("empty admin key in " + fname)
+	}
+	return nil
+}
+
+type adminFile struct {
+	*storage.Info
+	Url       string
+	Thumbnail string
+}
+
+type adminContext struct {
+	pageContext
+	Token     string
+	Message   string
+	Query     string
+	Stats     storage.Stats
+	StatsTime time.Time
+	Files     []adminFile
+	PrevPage  string
+	NextPage  string
+	LogDate   string
+	LogDays   []string
+	Entries   []LogEntry
+}
+
+func initAdmin() {
+	http.HandleFunc("/admin", adminAuth(handleAdmin))
+	http.HandleFunc("/admin/logs", adminAuth(handleAdminLogs))
+	http.HandleFunc("/admin/delete", adminAuth(adminAction("delete", func(id string) error {
+		return uploads.Remove(id)
+	})))
+	http.HandleFunc("/admin/block", adminAuth(adminAction("block", func(id string) error {
+		_, err := uploads.Block(id)
+		return err
+	})))
+}
+
+// isAdmin reports whether a request has the admin key as a HTTP basic auth
+// password (with any username) or as a bearer token
+func isAdmin(r *http.Request) bool {
+	key := ""
+	if _, pass, ok := r.BasicAuth(); ok {
+		key = pass
+	} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		key = auth[len("Bearer "):]
+	}
+	return adminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) == 1
+}
+
+func adminAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src *; style-src 'unsafe-inline'; form-action 'self'; frame-ancestors 'none'")
+		h(w, r)
+	}
+}
+
+// csrfToken returns the CSRF token for the nonce in the CSRF cookie of a
+// browser session
+func csrfToken(nonce string) string {
+	mac := hmac.New(sha256.New, csrfSecret)
+	mac.Write([]byte(adminKey))
+	mac.Write([]byte{0})
+	mac.Write([]byte(nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// csrfNonce returns the nonce of the CSRF cookie of a request, setting a new
+// one if the request has none
+func csrfNonce(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(csrfCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    nonce,
+		Path:     "/admin",
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nonce
+}
+
+// validCsrfToken reports whether a request has the CSRF token of the nonce
+// in its CSRF cookie
+func validCsrfToken(r *http.Request) bool {
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.PostFormValue("token")), []byte(csrfToken(c.Value))) == 1
+}
+
+func adminAction(action string, fn func(id string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "The method is not allowed for the requested URL.", http.StatusMethodNotAllowed)
+			return
+		}
+		if !validCsrfToken(r) {
+			LogAdmin(r, action, r.PostFormValue("id"), errors.New("invalid CSRF token"))
+			http.Error(w, "invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		id := r.PostFormValue("id")
+		err := fn(id)
+		resetAdminLinks()
+		LogAdmin(r, action, id, err)
+		msg := action + " " + id + ": ok"
+		if err != nil {
+			msg = action + " " + id + ": " + err.Error()
+		}
+		page := r.PostFormValue("return")
+		if !strings.HasPrefix(page, "/admin/") {
+			page = "/admin"
+		}
+		http.Redirect(w, r, page+"?"+url.Values{"msg": {msg}, "q": {r.PostFormValue("q")}}.Encode(), http.StatusSeeOther)
+	}
+}
+
+func newAdminContext(w http.ResponseWriter, r *http.Request) adminContext {
+	return adminContext{
+		pageContext: newContext(),
+		Token:       csrfToken(csrfNonce(w, r)),
+		Message:     r.FormValue("msg"),
+		Query:       strings.TrimSpace(r.FormValue("q")),
+	}
+}
+
+func handleAdmin(w http.ResponseWriter, r *http.Request) {
+	context := newAdminContext(w, r)
+	context.Stats, context.StatsTime = currentStorageStats()
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	if page < 0 {
+		page = 0
+	}
+
+	infos, err := findAdminFiles(context.Query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if page > 0 {
+		context.PrevPage = "/admin?" + url.Values{"q": {context.Query}, "page": {strconv.Itoa(page - 1)}}.Encode()
+	}
+	if (page+1)*adminMaxFiles < len(infos) {
+		context.NextPage = "/admin?" + url.Values{"q": {context.Query}, "page": {strconv.Itoa(page + 1)}}.Encode()
+	}
+	if page*adminMaxFiles < len(infos) {
+		infos = infos[page*adminMaxFiles:]
+	} else {
+		infos = nil
+	}
+	if len(infos) > adminMaxFiles {
+		infos = infos[:adminMaxFiles]
+	}
+	for _, info := range infos {
+		if full, err := uploads.FileInfo(info.Id); err == nil {
+			info = full
+		}
+		f := adminFile{Info: info, Url: strings.TrimRight(uploadUrl, "/") + "/" + info.Id}
+		if uploads.HasThumbnail(f.Id) {
+			f.Thumbnail = f.Url + "/thumb"
+		}
+		context.Files = append(context.Files, f)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := templates.ExecuteTemplate(w, "_admin.html", context); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// findAdminFiles returns the uploads whose ID or hash starts with q or whose
+// name contains q, newest first; an exact ID is looked up without walking
+// the uploads
+func findAdminFiles(q string) ([]*storage.Info, error) {
+	if q != "" {
+		if info, err := uploads.FileInfo(q); err == nil {
+			return []*storage.Info{info}, nil
+		}
+	}
+	links, err := walkAdminLinks()
+	if err != nil {
+		return nil, err
+	}
+	if q == "" {
+		return links, nil
+	}
+	q = strings.ToLower(q)
+	infos := []*storage.Info{}
+	for _, info := range links {
+		if strings.HasPrefix(strings.ToLower(info.Id), q) || strings.HasPrefix(info.Hash, q) || strings.Contains(strings.ToLower(info.Name), q) {
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+// walkAdminLinks returns the IDs of all uploads, newest first; since this
+// walks all IDs, the list is reused for adminLinksMaxAge or until an admin
+// action changes it
+func walkAdminLinks() ([]*storage.Info, error) {
+	adminLinksLock.Lock()
+	defer adminLinksLock.Unlock()
+	if adminLinks != nil && adminLinksStorage == uploads && time.Since(adminLinksTime) < adminLinksMaxAge {
+		return adminLinks, nil
+	}
+	// only the IDs are walked; the files are opened for the shown page only
+	links := []*storage.Info{}
+	err := uploads.WalkLinks(func(info *storage.Info) error {
+		links = append(links, info)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Time.After(links[j].Time) })
+	adminLinks, adminLinksTime, adminLinksStorage = links, time.Now(), uploads
+	return links, nil
+}
+
+func resetAdminLinks() {
+	adminLinksLock.Lock()
+	adminLinks = nil
+	adminLinksLock.Unlock()
+}
+
+func logDir() string {
+	if DefaultLogger != nil {
+		if fs := DefaultLogger.FileSink(); fs != nil {
+			return fs.Dir
+		}
+	}
+	return "log"
+}
+
+func handleAdminLogs(w http.ResponseWriter, r *http.Request) {
+	context := newAdminContext(w, r)
+	files, err := ioutil.ReadDir(logDir())
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		if name := strings.TrimSuffix(files[i].Name(), ".gz"); strings.HasSuffix(name, ".log.json") {
+			context.LogDays = append(context.LogDays, strings.TrimSuffix(name, ".log.json"))
+		}
+	}
+
+	context.LogDate = r.FormValue("date")
+	if context.LogDate == "" && len(context.LogDays) > 0 {
+		context.LogDate = context.LogDays[0]
+	}
+	if context.LogDate != "" {
+		if context.Entries, err = readLogEntries(path.Join(logDir(), path.Base(context.LogDate)+".log.json"), context.Query); err != nil {
+			context.Message = err.Error()
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := templates.ExecuteTemplate(w, "_admin-logs.html", context); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// readLogEntries returns the last entries of a log file containing q,
+// newest first
+func readLogEntries(fname, q string) ([]LogEntry, error) {
+	entries := []LogEntry{}
+	err := readLogFile(fname, func(line []byte, entry LogEntry) error {
+		if q != "" && !strings.Contains(string(line), q) {
+			return nil
+		}
+		entries = append(entries, entry)
+		if len(entries) > adminMaxLogEntries {
+			entries = entries[1:]
+		}
+		return nil
+	})
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, err
+}
+
+const adminStyle = `<style>
+body { font-family: sans-serif; margin: 1em 2em; }
+table { border-collapse: collapse; }
+td, th { border-bottom: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; vertical-align: middle; }
+td img { max-width: 64px; max-height: 64px; }
+.msg { background: #ffd; padding: 0.5em; }
+form.inline { display: inline; }
+</style>`
+
+const adminNav = `<h1>{{.SiteName}} admin</h1>
+<p><a href="/admin">Files</a> | <a href="/admin/reports">Reports</a> | <a href="/admin/logs">Logs</a></p>
+{{if .Message}}<p class="msg">{{.Message}}</p>{{end}}`
+
+const adminPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.SiteName}} &middot; Admin</title>
+` + adminStyle + `
+</head>
+<body>
+` + adminNav + `
+<h2>Storage</h2>
+{{if .StatsTime.IsZero}}<p>Storage statistics are still being computed.</p>{{else}}
+<table>
+<tr><th>Stored files</th><td>{{.Stats.Blobs}}</td></tr>
+<tr><th>IDs</th><td>{{.Stats.Ids}}</td></tr>
+<tr><th>Stored bytes</th><td>{{.Stats.Bytes}}</td></tr>
+<tr><th>Bytes on disk</th><td>{{.Stats.DiskBytes}}</td></tr>
+<tr><th>Dedup savings</th><td>{{.Stats.DedupSavings}}</td></tr>
+<tr><th>Computed at</th><td>{{.StatsTime.UTC.Format "2006-01-02 15:04:05"}}</td></tr>
+</table>{{end}}
+<h2>{{if .Query}}Search results{{else}}Recent uploads{{end}}</h2>
+<form method="get" action="/admin">
+<input type="search" name="q" value="{{.Query}}" placeholder="ID, hash or name">
+<input type="submit" value="Search">
+</form>
+<table>
+<tr><th></th><th>ID</th><th>Name</th><th>Size</th><th>Time</th><th>Hash</th><th></th></tr>
+{{range .Files}}
+<tr>
+<td>{{if .Thumbnail}}<img src="{{.Thumbnail}}" alt="">{{end}}</td>
+<td><a href="{{.Url}}">{{.Id}}</a></td>
+<td>{{.Name}}</td>
+<td>{{.Size}}</td>
+<td>{{.Time.UTC.Format "2006-01-02 15:04:05"}}</td>
+<td><a href="/admin?q={{.Hash}}">{{.Hash}}</a></td>
+<td>
+<form class="inline" method="post" action="/admin/delete"><input type="hidden" name="token" value="{{$.Token}}"><input type="hidden" name="q" value="{{$.Query}}"><input type="hidden" name="id" value="{{.Id}}"><input type="submit" value="Delete"></form>
+<form class="inline" method="post" action="/admin/block"><input type="hidden" name="token" value="{{$.Token}}"><input type="hidden" name="q" value="{{$.Query}}"><input type="hidden" name="id" value="{{.Id}}"><input type="submit" value="Ban hash"></form>
+</td>
+</tr>
+{{else}}
+<tr><td colspan="7">No files found.</td></tr>
+{{end}}
+</table>
+{{if or .PrevPage .NextPage}}<p>{{if .PrevPage}}<a href="{{.PrevPage}}">Newer</a>{{end}}{{if and .PrevPage .NextPage}} | {{end}}{{if .NextPage}}<a href="{{.NextPage}}">Older</a>{{end}}</p>{{end}}
+</body>
+</html>
+`
+
+const adminLogsPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.SiteName}} &middot; Admin logs</title>
+` + adminStyle + `
+</head>
+<body>
+` + adminNav + `
+<form method="get" action="/admin/logs">
+<select name="date">
+{{range .LogDays}}<option{{if eq . $.LogDate}} selected{{end}}>{{.}}</option>{{end}}
+</select>
+<input type="search" name="q" value="{{.Query}}" placeholder="filter">
+<input type="submit" value="Show">
+</form>
+<table>
+{{range .Entries}}
+<tr><td>{{range $k, $v := .}}<b>{{$k}}</b>: {{$v}}<br>{{end}}</td></tr>
+{{else}}
+<tr><td>No log entries.</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"git.clsr.net/gomf/storage"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func adminPageBody(t *testing.T, query url.Values) string {
+	w := httptest.NewRecorder()
+	handleAdmin(w, httptest.NewRequest("GET", "/admin?"+query.Encode(), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("/admin?%s: status %d: %s", query.Encode(), w.Code, w.Body)
+	}
+	return w.Body.String()
+}
+
+func TestAdminSearch(t *testing.T) {
+	setupTest(t)
+	loadBuiltinTemplates(t)
+	uploads.IdCharset = "aB"
+	id, _, _, _, err := uploads.New(strings.NewReader("a"), "Report.PDF", storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, _, _, err := uploads.New(strings.NewReader("b"), "other.txt", storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := uploads.FileInfo(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{id, strings.ToLower(id), strings.ToUpper(id), "report", "REPORT.pdf", info.Hash[:8]} {
+		body := adminPageBody(t, url.Values{"q": {q}})
+		if !strings.Contains(body, ">"+id+"<") {
+			t.Errorf("search for %q did not find %s", q, id)
+		}
+		if strings.Contains(body, ">"+other+"<") {
+			t.Errorf("search for %q found %s", q, other)
+		}
+	}
+}
+
+func TestAdminPages(t *testing.T) {
+	setupTest(t)
+	loadBuiltinTemplates(t)
+	n := adminMaxFiles + 5
+	for i := 0; i < n; i++ {
+		if _, _, _, _, err := uploads.New(strings.NewReader(fmt.Sprint(i)), fmt.Sprintf("file%d.txt", i), storage.Options{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := adminPageBody(t, url.Values{})
+	second := adminPageBody(t, url.Values{"page": {"1"}})
+	if c := strings.Count(first, "/admin/delete"); c != adminMaxFiles {
+		t.Errorf("first page lists %d files, want %d", c, adminMaxFiles)
+	}
+	if c := strings.Count(second, "/admin/delete"); c != n-adminMaxFiles {
+		t.Errorf("second page lists %d files, want %d", c, n-adminMaxFiles)
+	}
+	if !strings.Contains(first, ">Older<") || strings.Contains(first, ">Newer<") {
+		t.Error("first page does not link only to older files")
+	}
+	if strings.Contains(second, ">Older<") || !strings.Contains(second, ">Newer<") {
+		t.Error("second page does not link only to newer files")
+	}
+}
+
+func TestAdminLinksCache(t *testing.T) {
+	setupTest(t)
+	loadBuiltinTemplates(t)
+	first, _, _, _, err := uploads.New(strings.NewReader("first"), "first.txt", storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminPageBody(t, url.Values{})
+	second, _, _, _, err := uploads.New(strings.NewReader("second"), "second.txt", storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the walked list is reused, but exact IDs are looked up directly
+	if body := adminPageBody(t, url.Values{}); strings.Contains(body, ">"+second+"<") || !strings.Contains(body, ">"+first+"<") {
+		t.Error("the list of uploads was walked again")
+	}
+	if body := adminPageBody(t, url.Values{"q": {second}}); !strings.Contains(body, ">"+second+"<") {
+		t.Errorf("search for the new ID %s did not find it", second)
+	}
+	resetAdminLinks()
+	if body := adminPageBody(t, url.Values{}); !strings.Contains(body, ">"+second+"<") {
+		t.Error("the list of uploads was not walked after resetting it")
+	}
+}
+
+func TestAdminCsrf(t *testing.T) {
+	setupTest(t)
+	loadBuiltinTemplates(t)
+	id, _, _, _, err := uploads.New(strings.NewReader("a"), "a.txt", storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keeps the page listing a file, and its forms, after the first is removed
+	if _, _, _, _, err = uploads.New(strings.NewReader("b"), "b.txt", storage.Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	handleAdmin(w, httptest.NewRequest("GET", "/admin", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != csrfCookie || !cookies[0].HttpOnly {
+		t.Fatalf("CSRF cookies %v", cookies)
+	}
+	m := regexp.MustCompile(`name="token" value="([^"]+)"`).FindStringSubmatch(w.Body.String())
+	if m == nil {
+		t.Fatal("no CSRF token in the page")
+	}
+	token := m[1]
+	// the token is tied to the cookie of the session
+	if other := csrfToken("other nonce"); other == token {
+		t.Error("CSRF tokens of different sessions are equal")
+	}
+
+	remove := func(token string, cookie *http.Cookie) int {
+		r := httptest.NewRequest("POST", "/admin/delete", strings.NewReader(url.Values{"id": {id}, "token": {token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		adminAction("delete", uploads.Remove)(w, r)
+		return w.Code
+	}
+	if code := remove(token, nil); code != http.StatusForbidden {
+		t.Errorf("token without its cookie: status %d", code)
+	}
+	if code := remove(token, &http.Cookie{Name: csrfCookie, Value: "other nonce"}); code != http.StatusForbidden {
+		t.Errorf("token with another cookie: status %d", code)
+	}
+	if _, _, _, _, err = uploads.Get(id); err != nil {
+		t.Fatalf("file was removed with an invalid token: %s", err)
+	}
+	if code := remove(token, cookies[0]); code != http.StatusSeeOther {
+		t.Errorf("valid token: status %d", code)
+	}
+	if _, _, _, _, err = uploads.Get(id); err == nil {
+		t.Error("file was not removed with a valid token")
+	}
+
+	// a page view with the cookie keeps its nonce
+	r := httptest.NewRequest("GET", "/admin", nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	handleAdmin(w, r)
+	if len(w.Result().Cookies()) != 0 || !strings.Contains(w.Body.String(), token) {
+		t.Error("the CSRF nonce changed within a session")
+	}
+}
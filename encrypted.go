@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// client-side encrypted files are stored as IV || AES-GCM(len(meta) || meta || data),
+// where meta is a JSON object with the original name and type of the file and
+// the key is only ever part of the URL fragment
+
+func init() {
+	builtinPages["encrypt.html"] = encryptPage
+	builtinPages["_decrypt.html"] = decryptPage
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func handleDecrypt(w http.ResponseWriter, r *http.Request, id string) {
+	meta, err := uploads.GetMeta(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !meta.Encrypted {
+		http.NotFound(w, r)
+		return
+	}
+
+	context := newContext()
+	context.Id = id
+	context.Nonce = newNonce()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'nonce-"+context.Nonce+"'; style-src 'unsafe-inline'; connect-src 'self'; img-src blob:; media-src blob:")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := templates.ExecuteTemplate(w, "_decrypt.html", context); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+const cryptoScript = `
+function b64encode(buf) {
+	return btoa(String.fromCharCode.apply(null, new Uint8Array(buf))).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+function b64decode(str) {
+	str = str.replace(/-/g, '+').replace(/_/g, '/');
+	while (str.length % 4) {
+		str += '=';
+	}
+	return Uint8Array.from(atob(str), function(c) { return c.charCodeAt(0); });
+}
+`
+
+const encryptPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.SiteName}} &middot; Encrypted upload</title>
+</head>
+<body>
+<h1>{{.SiteName}}</h1>
+<p>Files are encrypted in your browser before they are uploaded. The key is only part of the link and is never sent to the server, so keep the whole link.</p>
+<p>Max upload size is {{.MaxSize}}.</p>
+<input type="file" id="files" multiple>
+<ul id="links"></ul>
+<script nonce="{{.Nonce}}">` + cryptoScript + `
+async function upload(file) {
+	var key = await crypto.subtle.generateKey({name: 'AES-GCM', length: 256}, true, ['encrypt']);
+	var iv = crypto.getRandomValues(new Uint8Array(12));
+	var meta = new TextEncoder().encode(JSON.stringify({name: file.name, type: file.type}));
+	var head = new Uint8Array(4);
+	new DataView(head.buffer).setUint32(0, meta.length);
+	var plain = await new Blob([head, meta, file]).arrayBuffer();
+	var data = await crypto.subtle.encrypt({name: 'AES-GCM', iv: iv}, key, plain);
+
+	var form = new FormData();
+	form.append('encrypted', '1');
+	form.append('files[]', new Blob([iv, data]), 'encrypted.bin');
+	var resp = await (await fetch('/upload.php?output=json', {method: 'POST', body: form})).json();
+	if (!resp.success) {
+		throw new Error(resp.description);
+	}
+	return resp.files[0].url + '/decrypt#' + b64encode(await crypto.subtle.exportKey('raw', key));
+}
+
+document.getElementById('files').addEventListener('change', function(ev) {
+	Array.prototype.forEach.call(ev.target.files, function(file) {
+		var li = document.createElement('li');
+		li.textContent = file.name + ': encrypting...';
+		document.getElementById('links').appendChild(li);
+		upload(file).then(function(url) {
+			var a = document.createElement('a');
+			a.href = url;
+			a.textContent = url;
+			li.textContent = file.name + ': ';
+			li.appendChild(a);
+		}, function(err) {
+			li.textContent = file.name + ': error: ' + err.message;
+		});
+	});
+});
+</script>
+</body>
+</html>
+`
+
+const decryptPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.SiteName}} &middot; Encrypted file</title>
+</head>
+<body>
+<h1>{{.SiteName}}</h1>
+<p id="status">Decrypting...</p>
+<div id="preview"></div>
+<script nonce="{{.Nonce}}">` + cryptoScript + `
+async function decrypt() {
+	if (location.hash.length < 2) {
+		throw new Error('the link is missing the decryption key');
+	}
+	var key = await crypto.subtle.importKey('raw', b64decode(location.hash.slice(1)), 'AES-GCM', false, ['decrypt']);
+	var resp = await fetch('../' + encodeURIComponent({{.Id}}));
+	if (!resp.ok) {
+		throw new Error(resp.status + ' ' + resp.statusText);
+	}
+	var data = new Uint8Array(await resp.arrayBuffer());
+	var plain = new Uint8Array(await crypto.subtle.decrypt({name: 'AES-GCM', iv: data.subarray(0, 12)}, key, data.subarray(12)));
+	var n = new DataView(plain.buffer).getUint32(0);
+	return {
+		meta: JSON.parse(new TextDecoder().decode(plain.subarray(4, 4 + n))),
+		data: plain.subarray(4 + n)
+	};
+}
+
+decrypt().then(function(file) {
+	var status = document.getElementById('status');
+	var a = document.createElement('a');
+	a.href = URL.createObjectURL(new Blob([file.data], {type: 'application/octet-stream'}));
+	a.download = file.meta.name;
+	a.textContent = 'Download ' + file.meta.name;
+	status.textContent = '';
+	status.appendChild(a);
+
+	// only preview types that cannot run scripts
+	var type = String(file.meta.type), el;
+	if (/^image\/(png|jpeg|gif|webp|bmp)$/.test(type)) {
+		el = document.createElement('img');
+	} else if (/^video\//.test(type)) {
+		el = document.createElement('video');
+		el.controls = true;
+	} else if (/^audio\//.test(type)) {
+		el = document.createElement('audio');
+		el.controls = true;
+	}
+	if (el) {
+		el.src = URL.createObjectURL(new Blob([file.data], {type: type}));
+		el.style.maxWidth = '100%';
+		document.getElementById('preview').appendChild(el);
+	}
+}, function(err) {
+	document.getElementById('status').textContent = 'Unable to decrypt the file: ' + err.message;
+});
+</script>
+</body>
+</html>
+`
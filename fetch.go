@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"git.clsr.net/gomf/storage"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"syscall"
+	"time"
+)
+
+const maxFetchUrl = 4096
+
+var (
+	// urlUpload enables uploading files from URLs fetched by the server;
+	// fetching from private, loopback and link-local addresses is only
+	// allowed with fetchPrivate
+	urlUpload         bool
+	fetchPrivate      bool
+	fetchTimeout      = 60 * time.Second
+	fetchMaxRedirects = 5
+)
+
+// errFetchInvalid is returned for URLs that cannot be fetched
+type errFetchInvalid struct{ msg string }
+
+func (e errFetchInvalid) Error() string { return e.msg }
+
+// errFetchForbidden is returned for URLs on disallowed addresses
+type errFetchForbidden struct{ addr string }
+
+func (e errFetchForbidden) Error() string { return "fetching from " + e.addr + " is not allowed" }
+
+// errFetch wraps errors that happen while reading a fetched file
+type errFetch struct{ err error }
+
+func (e errFetch) Error() string { return "error fetching file: " + e.err.Error() }
+
+type fetchReader struct{ r io.Reader }
+
+func (f fetchReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = errFetch{err}
+	}
+	return n, err
+}
+
+// fetchAllowed reports whether ip is a public address
+func fetchAllowed(ip net.IP) bool {
+	if fetchPrivate {
+		return true
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		// 100.64.0.0/10 carrier-grade NAT, 192.0.0.0/24 IETF protocol assignments
+		if ip[0] == 0 || (ip[0] == 100 && ip[1]&0xc0 == 64) || (ip[0] == 192 && ip[1] == 0 && ip[2] == 0) {
+			return false
+		}
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// checkFetchAddr is called for every connection after the name is resolved,
+// so names that resolve to disallowed addresses are rejected too
+func checkFetchAddr(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !fetchAllowed(ip) {
+		return errFetchForbidden{host}
+	}
+	return nil
+}
+
+var fetchClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: checkFetchAddr,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) > fetchMaxRedirects {
+			return errFetchInvalid{"too many redirects"}
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return errFetchInvalid{"redirect to unsupported URL scheme " + req.URL.Scheme}
+		}
+		return nil
+	},
+}
+
+// fetchUrl starts downloading a file from a URL; it returns the response
+// body and the name of the file
+func fetchUrl(ctx context.Context, rawurl string) (body io.ReadCloser, name string, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(rawurl) > maxFetchUrl {
+		return nil, "", errFetchInvalid{"invalid URL: " + rawurl}
+	}
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, "", errFetchInvalid{err.Error()}
+	}
+	req.Header.Set("User-Agent", "gomf ("+siteName+")")
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		cancel()
+		var forbidden errFetchForbidden
+		var invalid errFetchInvalid
+		if errors.As(err, &forbidden) {
+			return nil, "", forbidden
+		} else if errors.As(err, &invalid) {
+			return nil, "", invalid
+		}
+		return nil, "", errFetch{err}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		cancel()
+		return nil, "", errFetch{errors.New(resp.Status)}
+	}
+	if uploads.MaxSize > 0 && resp.ContentLength > uploads.MaxSize {
+		resp.Body.Close()
+		cancel()
+		return nil, "", storage.ErrTooLarge{Size: uploads.MaxSize}
+	}
+
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		name = path.Base(params["filename"])
+	} else {
+		name = path.Base(resp.Request.URL.Path)
+	}
+	if name == "/" || name == "." || name == "" {
+		name = "file"
+	}
+	return cancelCloser{resp.Body, cancel}, name, nil
+}
+
+type cancelCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFetchAllowed(t *testing.T) {
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"93.184.216.34", true},
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"10.0.0.1", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"192.0.0.1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"224.0.0.1", false},
+		{"::1", false},
+		{"::", false},
+		{"fe80::1", false},
+		{"fc00::1", false},
+		{"ff02::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+	}
+	oldPrivate := fetchPrivate
+	defer func() { fetchPrivate = oldPrivate }()
+	for _, test := range tests {
+		fetchPrivate = false
+		if allowed := fetchAllowed(net.ParseIP(test.ip)); allowed != test.allowed {
+			t.Errorf("fetchAllowed(%s) = %v, want %v", test.ip, allowed, test.allowed)
+		}
+		fetchPrivate = true
+		if !fetchAllowed(net.ParseIP(test.ip)) {
+			t.Errorf("fetchAllowed(%s) = false with fetchPrivate", test.ip)
+		}
+	}
+}
+
+// countingServer starts a test server that counts its requests
+func countingServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *int32) {
+	var n int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&n, 1)
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &n
+}
+
+func TestFetchUrlPrivate(t *testing.T) {
+	setupTest(t)
+	oldPrivate := fetchPrivate
+	fetchPrivate = false
+	defer func() { fetchPrivate = oldPrivate }()
+
+	private, privateRequests := countingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "internal data")
+	})
+	redirect, _ := countingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, private.URL+"/secret", http.StatusFound)
+	})
+	schemeRedirect, _ := countingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	})
+
+	// the redirecting servers stand in for public hosts; every other
+	// address is checked as usual
+	transport := fetchClient.Transport.(*http.Transport)
+	oldDial := transport.DialContext
+	transport.DialContext = (&net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			if address == redirect.Listener.Addr().String() || address == schemeRedirect.Listener.Addr().String() {
+				return nil
+			}
+			return checkFetchAddr(network, address, c)
+		},
+	}).DialContext
+	defer func() {
+		transport.DialContext = oldDial
+		transport.CloseIdleConnections()
+	}()
+
+	tests := []struct {
+		url string
+		err error
+	}{
+		{private.URL + "/secret", errFetchForbidden{}},
+		{redirect.URL + "/file", errFetchForbidden{}},
+		{schemeRedirect.URL + "/file", errFetchInvalid{}},
+		{"file:///etc/passwd", errFetchInvalid{}},
+		{"gopher://example.com/", errFetchInvalid{}},
+		{"http:///path", errFetchInvalid{}},
+	}
+	for _, test := range tests {
+		body, _, err := fetchUrl(context.Background(), test.url)
+		if err == nil {
+			data, _ := ioutil.ReadAll(body)
+			body.Close()
+			t.Errorf("%s: fetched %q", test.url, data)
+			continue
+		}
+		switch test.err.(type) {
+		case errFetchForbidden:
+			if _, ok := err.(errFetchForbidden); !ok {
+				t.Errorf("%s: got %T %q, want errFetchForbidden", test.url, err, err)
+			}
+		case errFetchInvalid:
+			if _, ok := err.(errFetchInvalid); !ok {
+				t.Errorf("%s: got %T %q, want errFetchInvalid", test.url, err, err)
+			}
+		}
+	}
+	if n := atomic.LoadInt32(privateRequests); n != 0 {
+		t.Errorf("private server received %d requests", n)
+	}
+}
+
+func TestUploadFromUrl(t *testing.T) {
+	setupApiTest(t)
+	oldUpload, oldPrivate := urlUpload, fetchPrivate
+	defer func() { urlUpload, fetchPrivate = oldUpload, oldPrivate }()
+
+	srv, requests := countingServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="../named.txt"`)
+		io.WriteString(w, "fetched contents")
+	})
+	upload := func(url string) *httptest.ResponseRecorder {
+		body, ct := multipartBody(t, formField{"url", "", url})
+		return apiRequest("POST", apiPrefix+"/upload", body, ct, false)
+	}
+
+	urlUpload, fetchPrivate = false, true
+	checkError(t, upload(srv.URL), http.StatusForbidden, "disabled URL upload")
+
+	urlUpload, fetchPrivate = true, false
+	checkError(t, upload(srv.URL), http.StatusForbidden, "private URL upload")
+	checkError(t, upload("ftp://example.com/a.txt"), http.StatusBadRequest, "ftp URL upload")
+	if n := atomic.LoadInt32(requests); n != 0 {
+		t.Errorf("server received %d requests for forbidden uploads", n)
+	}
+
+	fetchPrivate = true
+	resp := apiUploadFiles(t, formField{"url", "", srv.URL + "/path/ignored.bin"})
+	if len(resp.Files) != 1 || resp.Files[0].Name != "named.txt" || resp.Files[0].Size != 16 {
+		t.Errorf("URL upload returned %+v", resp.Files)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"git.clsr.net/gomf/storage"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type fileInfo struct {
+	Id        string    `json:"id"`
+	Url       string    `json:"url"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Hash      string    `json:"hash"`
+	Mime      string    `json:"mime"`
+	Time      time.Time `json:"time"`
+	Downloads int64     `json:"downloads"`
+	Encrypted bool      `json:"encrypted,omitempty"`
+	Thumbnail string    `json:"thumbnail,omitempty"`
+}
+
+// countsAsDownload reports whether a request fetches a file from the start,
+// so resumed and partial downloads are only counted once and revalidating
+// cached copies is not counted
+func countsAsDownload(r *http.Request) bool {
+	if r.Method != http.MethodGet || r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		return false
+	}
+	rng := strings.TrimSpace(r.Header.Get("Range"))
+	return rng == "" || strings.HasPrefix(rng, "bytes=0-")
+}
+
+// downloadFlushInterval is how often download counts kept in memory are
+// written to the upload metadata
+const downloadFlushInterval = 30 * time.Second
+
+// startDownloadFlush periodically writes download counts to the metadata;
+// the returned function stops it and writes the remaining counts
+func startDownloadFlush() (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(downloadFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			if err := uploads.FlushDownloads(); err != nil {
+				fmt.Fprintf(os.Stderr, "error saving download counts: %s\n", err)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		if err := uploads.FlushDownloads(); err != nil {
+			fmt.Fprintf(os.Stderr, "error saving download counts: %s\n", err)
+		}
+	}
+}
+
+// setInfoHeaders exposes the information of /api/files/ID as headers of
+// GET and HEAD requests for the file, counts the download and returns the
+// metadata of the file
+func setInfoHeaders(w http.ResponseWriter, r *http.Request, id, hash string, size int64, modtime time.Time) storage.Meta {
+	meta, err := uploads.GetMeta(id)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if countsAsDownload(r) {
+		if meta.Downloads, err = uploads.AddDownload(id); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	w.Header().Set("X-File-Hash", hash)
+	w.Header().Set("X-File-Size", strconv.FormatInt(size, 10))
+	w.Header().Set("X-Upload-Time", modtime.UTC().Format(time.RFC3339))
+	w.Header().Set("X-Download-Count", strconv.FormatInt(meta.Downloads, 10))
+	if meta.Mime != "" {
+		w.Header().Set("X-Detected-Type", meta.Mime)
+	}
+	return meta
+}
+
+// handleFileInfo serves /api/files/ID as JSON
+func handleFileInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		respond(w, "json", response{ErrorCode: http.StatusMethodNotAllowed, Description: "The method is not allowed for the requested URL."})
+		return
+	}
+	writeFileInfo(w, strings.TrimPrefix(r.URL.Path, "/api/files/"))
+}
+
+func writeFileInfo(w http.ResponseWriter, id string) {
+	info, err := uploads.FileInfo(id)
+	if err == nil {
+		var meta storage.Meta
+		if meta, err = uploads.GetMeta(id); err == nil && meta.Disabled {
+			err = storage.ErrDisabled{Id: id}
+		}
+	}
+	if err != nil {
+		respond(w, "json", response{ErrorCode: storageErrorCode(err), Description: err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(newFileInfo(info))
+}
+
+func newFileInfo(info *storage.Info) fileInfo {
+	fi := fileInfo{
+		Id:        info.Id,
+		Url:       strings.TrimRight(uploadUrl, "/") + "/" + info.Id,
+		Name:      info.Name,
+		Size:      info.Size,
+		Hash:      info.Hash,
+		Mime:      info.Mime,
+		Time:      info.Time.UTC(),
+		Downloads: info.Downloads,
+		Encrypted: info.Encrypted,
+	}
+	if uploads.HasThumbnail(info.Id) {
+		fi.Thumbnail = fi.Url + "/thumb"
+	}
+	return fi
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"git.clsr.net/gomf/storage"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDownloadCount(t *testing.T) {
+	setupTest(t)
+	id, _, _, _, err := uploads.New(strings.NewReader("some text"), "a.txt", storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := []struct {
+		method, rng string
+		count       string
+	}{
+		{"GET", "", "1"},
+		{"HEAD", "", "1"},
+		{"GET", "bytes=0-3", "2"},
+		{"GET", "bytes=4-", "2"},
+		{"GET", "", "3"},
+	}
+	for _, req := range requests {
+		r := httptest.NewRequest(req.method, "/"+id, nil)
+		if req.rng != "" {
+			r.Header.Set("Range", req.rng)
+		}
+		w := httptest.NewRecorder()
+		handleFile(w, r)
+		if c := w.Header().Get("X-Download-Count"); c != req.count {
+			t.Errorf("%s %q: X-Download-Count %q, want %q", req.method, req.rng, c, req.count)
+		}
+	}
+
+	if err = uploads.FlushDownloads(); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handleFileInfo(w, httptest.NewRequest("GET", "/api/files/"+id, nil))
+	var info fileInfo
+	if err = json.NewDecoder(w.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || info.Id != id || info.Downloads != 3 || info.Name != "a.txt" {
+		t.Errorf("/api/files/%s: %d %+v", id, w.Code, info)
+	}
+}
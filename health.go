@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"git.clsr.net/gomf/storage"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var (
+	// minFreeSpace is the free disk space in bytes below which gomf is not
+	// ready; 0 disables the check
+	minFreeSpace int64
+
+	shuttingDown int32
+)
+
+type healthCheck struct {
+	Name   string `json:"name"`
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func initHealth() {
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+}
+
+func writeHealth(w http.ResponseWriter, ok bool, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, true, map[string]string{"status": "ok"})
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := []healthCheck{
+		check("shutdown", func() (string, error) {
+			if atomic.LoadInt32(&shuttingDown) != 0 {
+				return "", fmt.Errorf("shutting down")
+			}
+			return "", nil
+		}),
+		check("storage", func() (string, error) { return "", uploads.Writable() }),
+		check("disk_space", checkDiskSpace),
+		check("templates", func() (string, error) {
+			if templates == nil || len(templates.Templates()) == 0 {
+				return "", fmt.Errorf("templates not loaded")
+			}
+			return "", nil
+		}),
+		check("libmagic", func() (string, error) {
+			_, err := storage.GetMimeTypeBuffer([]byte("gomf"))
+			return "", err
+		}),
+	}
+	if DefaultLogger != nil {
+		if fs := DefaultLogger.FileSink(); fs != nil {
+			checks = append(checks, check("log", func() (string, error) { return "", dirWritable(fs.Dir) }))
+		}
+	}
+
+	ready := true
+	for _, c := range checks {
+		ready = ready && c.Ok
+	}
+	status := "ready"
+	if !ready {
+		status = "not ready"
+	}
+	writeHealth(w, ready, struct {
+		Status string        `json:"status"`
+		Checks []healthCheck `json:"checks"`
+	}{status, checks})
+}
+
+func check(name string, fn func() (string, error)) healthCheck {
+	detail, err := fn()
+	if err != nil {
+		return healthCheck{Name: name, Detail: err.Error()}
+	}
+	return healthCheck{Name: name, Ok: true, Detail: detail}
+}
+
+func checkDiskSpace() (string, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(uploads.Folder, &st); err != nil {
+		return "", err
+	}
+	free := int64(uint64(st.Bavail) * uint64(st.Bsize))
+	detail := fmt.Sprintf("%d bytes free", free)
+	if minFreeSpace > 0 && free < minFreeSpace {
+		return "", fmt.Errorf("%s, less than %d", detail, minFreeSpace)
+	}
+	return detail, nil
+}
+
+// dirWritable checks that files can be created in dir, or in the closest
+// existing folder it would be created in, without creating anything
+func dirWritable(dir string) error {
+	for {
+		err := storage.DirWritable(dir)
+		if parent := path.Dir(dir); os.IsNotExist(err) && parent != dir {
+			dir = parent
+			continue
+		}
+		return err
+	}
+}
+
+// waitForShutdown waits for SIGINT or SIGTERM, then reports not being ready
+// for delay before gracefully shutting down the servers
+func waitForShutdown(servers []*http.Server, delay, timeout time.Duration) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	signal.Stop(sig)
+	atomic.StoreInt32(&shuttingDown, 1)
+	fmt.Println("shutting down")
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	setupTest(t)
+	loadBuiltinTemplates(t)
+
+	readyz := func() (int, map[string]bool) {
+		w := httptest.NewRecorder()
+		handleReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+		var resp struct {
+			Checks []healthCheck `json:"checks"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		checks := make(map[string]bool)
+		for _, c := range resp.Checks {
+			checks[c.Name] = c.Ok
+		}
+		return w.Code, checks
+	}
+
+	code, checks := readyz()
+	if code != http.StatusOK {
+		t.Errorf("got status %d, want %d: %v", code, http.StatusOK, checks)
+	}
+	// probes must not write to the storage folders
+	for _, folder := range []string{"temp", "files", "ids", "meta"} {
+		files, err := ioutil.ReadDir(path.Join(uploads.Folder, folder))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 0 {
+			t.Errorf("readyz left %d files in %s", len(files), folder)
+		}
+	}
+
+	if err := os.RemoveAll(path.Join(uploads.Folder, "meta")); err != nil {
+		t.Fatal(err)
+	}
+	code, checks = readyz()
+	if code != http.StatusServiceUnavailable || checks["storage"] {
+		t.Errorf("got status %d and storage check %v without a meta folder", code, checks["storage"])
+	}
+}
+
+func TestDirWritable(t *testing.T) {
+	dir := setupTest(t)
+	missing := path.Join(dir, "log", "audit")
+	if err := dirWritable(missing); err != nil {
+		t.Errorf("missing folder in a writable one: %s", err)
+	}
+	if _, err := os.Stat(path.Join(dir, "log")); !os.IsNotExist(err) {
+		t.Error("checking a missing folder created it")
+	}
+	f := path.Join(dir, "file")
+	if err := ioutil.WriteFile(f, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := dirWritable(path.Join(f, "log")); err == nil {
+		t.Error("folder inside a file is writable")
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"html/template"
+	"strings"
+)
+
+// a small lexical highlighter that marks keywords, strings, comments and
+// numbers; it does not parse languages and is only meant for reading pastes
+
+type language struct {
+	name         string
+	keywords     map[string]bool
+	lineComments []string
+	blockComment [2]string
+	quotes       string
+	// multiline quotes may span lines
+	multiline string
+}
+
+func newLanguage(name, keywords string, lineComments []string, blockComment [2]string, quotes, multiline string) *language {
+	l := &language{name, make(map[string]bool), lineComments, blockComment, quotes, multiline}
+	for _, k := range strings.Fields(keywords) {
+		l.keywords[k] = true
+	}
+	return l
+}
+
+var (
+	cBlock  = [2]string{"/*", "*/"}
+	noBlock [2]string
+
+	langC = newLanguage("C", `auto break case char const continue default do double else enum extern float for goto if inline int long
+		register restrict return short signed sizeof static struct switch typedef union unsigned void volatile while
+		bool class delete explicit false friend mutable namespace new nullptr operator private protected public template
+		this throw true try catch typename using virtual #include #define #ifdef #ifndef #endif #if #else #pragma`,
+		[]string{"//"}, cBlock, `"'`, "")
+	langGo = newLanguage("Go", `break case chan const continue default defer else fallthrough for func go goto if import interface
+		map package range return select struct switch type var true false nil iota`, []string{"//"}, cBlock, "\"'`", "`")
+	langJava = newLanguage("Java", `abstract assert boolean break byte case catch char class const continue default do double else
+		enum extends final finally float for goto if implements import instanceof int interface long native new package
+		private protected public return short static super switch synchronized this throw throws transient try void
+		volatile while true false null var val fun when object override`, []string{"//"}, cBlock, `"'`, "")
+	langJs = newLanguage("JavaScript", `async await break case catch class const continue debugger default delete do else export
+		extends finally for function if import in instanceof let new of return super switch this throw try typeof var void
+		while with yield true false null undefined interface type enum implements private public readonly`,
+		[]string{"//"}, cBlock, "\"'`", "`")
+	langPy = newLanguage("Python", `and as assert async await break class continue def del elif else except False finally for from
+		global if import in is lambda None nonlocal not or pass raise return True try while with yield self`,
+		[]string{"#"}, noBlock, `"'`, "")
+	langSh = newLanguage("Shell", `if then else elif fi case esac for while until do done in function return local export
+		readonly shift exit break continue echo set unset`, []string{"#"}, noBlock, `"'`, `"'`)
+	langRuby = newLanguage("Ruby", `alias and begin break case class def defined? do else elsif end ensure false for if in module
+		next nil not or redo rescue retry return self super then true undef unless until when while yield require`,
+		[]string{"#"}, [2]string{"=begin", "=end"}, `"'`, "")
+	langRust = newLanguage("Rust", `as async await break const continue crate dyn else enum extern false fn for if impl in let loop
+		match mod move mut pub ref return self Self static struct super trait true type unsafe use where while`,
+		[]string{"//"}, cBlock, `"`, `"`)
+	langPhp = newLanguage("PHP", `abstract and array as break case catch class clone const continue declare default do echo else
+		elseif empty endfor endforeach endif endwhile extends final finally fn for foreach function global if implements
+		include instanceof interface isset list namespace new or private protected public require require_once return
+		static switch throw trait try unset use var while true false null`, []string{"//", "#"}, cBlock, `"'`, `"'`)
+	langSql = newLanguage("SQL", `select from where insert into values update set delete create table drop alter add index primary
+		key foreign references join left right inner outer on group by order having limit offset and or not null is in
+		as distinct union all case when then else end begin commit rollback SELECT FROM WHERE INSERT INTO VALUES UPDATE
+		SET DELETE CREATE TABLE DROP ALTER ADD INDEX PRIMARY KEY FOREIGN REFERENCES JOIN LEFT RIGHT INNER OUTER ON GROUP
+		BY ORDER HAVING LIMIT OFFSET AND OR NOT NULL IS IN AS DISTINCT UNION ALL CASE WHEN THEN ELSE END BEGIN COMMIT
+		ROLLBACK`, []string{"--"}, cBlock, `'"`, "")
+	langCss  = newLanguage("CSS", `@media @import @font-face @keyframes !important`, nil, cBlock, `"'`, "")
+	langXml  = newLanguage("XML", ``, nil, [2]string{"<!--", "-->"}, `"`, `"`)
+	langConf = newLanguage("Config", `true false yes no on off null`, []string{"#", ";"}, noBlock, `"'`, "")
+	langLua  = newLanguage("Lua", `and break do else elseif end false for function goto if in local nil not or repeat return then
+		true until while`, []string{"--"}, [2]string{"--[[", "]]"}, `"'`, "")
+	langHs = newLanguage("Haskell", `case class data default deriving do else if import in infix infixl infixr instance let module
+		newtype of then type where`, []string{"--"}, [2]string{"{-", "-}"}, `"`, "")
+)
+
+var languages = map[string]*language{
+	".c": langC, ".h": langC, ".cc": langC, ".cpp": langC, ".cxx": langC, ".hpp": langC, ".cs": langC,
+	".go":   langGo,
+	".java": langJava, ".kt": langJava, ".scala": langJava,
+	".js": langJs, ".mjs": langJs, ".ts": langJs, ".jsx": langJs, ".tsx": langJs, ".json": langJs,
+	".py": langPy,
+	".sh": langSh, ".bash": langSh, ".zsh": langSh,
+	".rb":   langRuby,
+	".rs":   langRust,
+	".php":  langPhp,
+	".sql":  langSql,
+	".css":  langCss,
+	".html": langXml, ".htm": langXml, ".xml": langXml, ".svg": langXml,
+	".yml": langConf, ".yaml": langConf, ".toml": langConf, ".ini": langConf, ".conf": langConf, ".cfg": langConf,
+	".lua": langLua,
+	".hs":  langHs,
+}
+
+type token struct {
+	class string // "", "k", "s", "c" or "n"
+	text  string
+}
+
+func isIdent(c byte, first bool) bool {
+	return c == '_' || c == '#' || c == '@' || c == '?' || c == '!' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+		c >= 0x80 || (!first && (c >= '0' && c <= '9' || c == '-'))
+}
+
+func (l *language) tokenize(src string) []token {
+	tokens := []token{}
+	// adjacent plain tokens are merged by reslicing src from the start of the
+	// first one, so merging stays linear in the size of src
+	plain := 0
+	emit := func(class string, start, end int) {
+		if n := len(tokens); n > 0 && tokens[n-1].class == "" && class == "" {
+			tokens[n-1].text = src[plain:end]
+			return
+		}
+		if class == "" {
+			plain = start
+		}
+		tokens = append(tokens, token{class, src[start:end]})
+	}
+	for i := 0; i < len(src); {
+		rest := src[i:]
+		if l.blockComment[0] != "" && strings.HasPrefix(rest, l.blockComment[0]) {
+			end := strings.Index(rest[len(l.blockComment[0]):], l.blockComment[1])
+			n := len(rest)
+			if end >= 0 {
+				n = len(l.blockComment[0]) + end + len(l.blockComment[1])
+			}
+			emit("c", i, i+n)
+			i += n
+			continue
+		}
+		comment := false
+		for _, lc := range l.lineComments {
+			if strings.HasPrefix(rest, lc) {
+				comment = true
+				break
+			}
+		}
+		if comment {
+			n := strings.IndexByte(rest, '\n')
+			if n < 0 {
+				n = len(rest)
+			}
+			emit("c", i, i+n)
+			i += n
+			continue
+		}
+		c := rest[0]
+		switch {
+		case strings.IndexByte(l.quotes, c) >= 0:
+			multiline := strings.IndexByte(l.multiline, c) >= 0
+			n := 1
+			for n < len(rest) && rest[n] != c && (multiline || rest[n] != '\n') {
+				if rest[n] == '\\' && c != '`' {
+					n++
+				}
+				n++
+			}
+			if n < len(rest) && rest[n] == c {
+				n++
+			}
+			if n > len(rest) {
+				n = len(rest)
+			}
+			emit("s", i, i+n)
+			i += n
+		case c >= '0' && c <= '9':
+			n := 1
+			for n < len(rest) && (isIdent(rest[n], false) || rest[n] == '.') && rest[n] != '-' {
+				n++
+			}
+			emit("n", i, i+n)
+			i += n
+		case isIdent(c, true):
+			n := 1
+			for n < len(rest) && isIdent(rest[n], false) && !(rest[n] == '-' && l != langCss) {
+				n++
+			}
+			if l.keywords[rest[:n]] {
+				emit("k", i, i+n)
+			} else {
+				emit("", i, i+n)
+			}
+			i += n
+		default:
+			emit("", i, i+1)
+			i++
+		}
+	}
+	return tokens
+}
+
+// highlight returns the lines of src as HTML with spans marking tokens; l may
+// be nil for plain text
+func highlight(l *language, src string) []template.HTML {
+	var tokens []token
+	if l != nil {
+		tokens = l.tokenize(src)
+	} else {
+		tokens = []token{{"", src}}
+	}
+	lines := []template.HTML{}
+	var line strings.Builder
+	for _, t := range tokens {
+		parts := strings.Split(t.text, "\n")
+		for i, part := range parts {
+			if i > 0 {
+				lines = append(lines, template.HTML(line.String()))
+				line.Reset()
+			}
+			if part == "" {
+				continue
+			}
+			if t.class != "" {
+				line.WriteString(`<span class="` + t.class + `">` + template.HTMLEscapeString(part) + `</span>`)
+			} else {
+				line.WriteString(template.HTMLEscapeString(part))
+			}
+		}
+	}
+	if line.Len() > 0 || len(lines) == 0 {
+		lines = append(lines, template.HTML(line.String()))
+	}
+	return lines
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"html/template"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		l      *language
+		src    string
+		tokens []token
+	}{
+		{langGo, `x := "a" + 12 // c`, []token{{"", "x := "}, {"s", `"a"`}, {"", " + "}, {"n", "12"}, {"", " "}, {"c", "// c"}}},
+		{langGo, "func f() {}", []token{{"k", "func"}, {"", " f() {}"}}},
+		{langC, "a /* b\nc */ d", []token{{"", "a "}, {"c", "/* b\nc */"}, {"", " d"}}},
+		{langPy, "'x\ny", []token{{"s", "'x"}, {"", "\ny"}}},
+	}
+	for _, test := range tests {
+		if tokens := test.l.tokenize(test.src); !reflect.DeepEqual(tokens, test.tokens) {
+			t.Errorf("%s tokenize(%q) = %q, want %q", test.l.name, test.src, tokens, test.tokens)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	lines := highlight(langGo, "if a < b {\n\treturn\n}")
+	want := []template.HTML{`<span class="k">if</span> a &lt; b {`, "\t" + `<span class="k">return</span>`, "}"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("highlight = %q, want %q", lines, want)
+	}
+}
+
+func TestHighlightLarge(t *testing.T) {
+	src := strings.Repeat("a = b; ", maxViewSize/7)
+	start := time.Now()
+	tokens := langGo.tokenize(src)
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("tokenizing %d bytes took %v", len(src), d)
+	}
+	if len(tokens) != 1 || tokens[0].text != src {
+		t.Errorf("plain source was split into %d tokens", len(tokens))
+	}
+}
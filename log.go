@@ -1,10 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	crand "crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
-	"encoding/json"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
@@ -15,7 +22,8 @@ import (
 )
 
 type Logger struct {
-	LogDir        string
+	// Sinks receive the entries after the privacy options are applied
+	Sinks         []LogSink
 	LogIP         bool
 	LogUserAgent  bool
 	LogReferer    bool
@@ -23,36 +31,50 @@ type Logger struct {
 	HashUserAgent bool
 	HashReferer   bool
 	HashSalt      string
+	// HashKey is the HMAC-SHA256 key for hashed log entries; if it is unset,
+	// the legacy SHA-1 with HashSalt is used, and values are not logged at
+	// all without a salt; with HashKeyRotate, a key derived from HashKey and
+	// the date is used so hashes can only be linked within a day
+	HashKey       []byte
+	HashKeyRotate bool
 	ProxyCount    int
-	logFile       *os.File
-	encoder       *json.Encoder
-	lastDate      string
-	lock          sync.Mutex
+	// LogDownloads enables download entries; only a DownloadSampleRate
+	// fraction of downloads is logged
+	LogDownloads       bool
+	DownloadSampleRate float64
+	lock               sync.Mutex
 }
 
 type LogEntry map[string]interface{}
 
 func InitLogger(logdir string) *Logger {
 	return &Logger{
-		LogDir: logdir,
+		Sinks: []LogSink{NewFileSink(logdir)},
 	}
 }
 
 func (l *Logger) Log(entry LogEntry) {
 	l.lock.Lock()
 	defer l.lock.Unlock()
-	_, err := l.getLogFile()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error opening log file: %s\n", err)
-		return
+	for _, sink := range l.Sinks {
+		if err := sink.WriteEntry(entry); err != nil {
+			fmt.Fprintf(os.Stderr, "error writing to log: %s\n", err)
+		}
 	}
-	err = l.encoder.Encode(entry)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error writing to log: %s\n", err)
+}
+
+// FileSink returns the first file sink of the logger, or nil if it does not
+// log to files
+func (l *Logger) FileSink() *FileSink {
+	for _, sink := range l.Sinks {
+		if fs, ok := sink.(*FileSink); ok {
+			return fs
+		}
 	}
+	return nil
 }
 
-func (l *Logger) LogUpload(req *http.Request, res result) {
+func (l *Logger) clientIP(req *http.Request) string {
 	host, _, _ := net.SplitHostPort(req.RemoteAddr)
 	if l.ProxyCount > 0 {
 		ffs := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
@@ -67,8 +89,12 @@ func (l *Logger) LogUpload(req *http.Request, res result) {
 			host = ffs[len(ffs)-l.ProxyCount]
 		}
 	}
+	return strings.TrimSpace(host)
+}
+
+func (l *Logger) LogUpload(req *http.Request, res result) {
 	l.logUpload(
-		host,               // ip
+		l.clientIP(req),    // ip
 		req.UserAgent(),    // userAgent
 		req.Referer(),      // referer
 		res.Name,           // origName
@@ -79,35 +105,177 @@ func (l *Logger) LogUpload(req *http.Request, res result) {
 }
 
 func (l *Logger) logUpload(ip, userAgent, referer, origName, idext, hash string, size int64) {
-	if !l.LogIP {
+	ip, userAgent, referer, keyId := l.anonymize(ip, userAgent, referer)
+	l.Log(withKeyId(keyId, LogEntry{
+		"type":       "upload",
+		"timestamp":  time.Now().UTC().Format(time.RFC3339),
+		"ip":         ip,
+		"user_agent": userAgent,
+		"referer":    referer,
+		"orig_name":  origName,
+		"id":         idext,
+		"hash":       hash,
+		"size":       size,
+	}))
+}
+
+// LogLink logs the creation of a short link
+func (l *Logger) LogLink(req *http.Request, id, target string) {
+	ip, userAgent, referer, keyId := l.anonymize(l.clientIP(req), req.UserAgent(), req.Referer())
+	l.Log(withKeyId(keyId, LogEntry{
+		"type":       "link",
+		"timestamp":  time.Now().UTC().Format(time.RFC3339),
+		"ip":         ip,
+		"user_agent": userAgent,
+		"referer":    referer,
+		"id":         id,
+		"url":        target,
+	}))
+}
+
+// SampleDownload reports whether a download should be logged
+func (l *Logger) SampleDownload() bool {
+	return l.LogDownloads && (l.DownloadSampleRate >= 1 || rand.Float64() < l.DownloadSampleRate)
+}
+
+// LogDownload logs a request for an uploaded file; view is the requested
+// view of the file (e.g. "thumb"), or empty for the file itself, and bytes is
+// the count of body bytes sent
+func (l *Logger) LogDownload(req *http.Request, idext, view string, status int, bytes int64) {
+	ip, userAgent, referer, keyId := l.anonymize(l.clientIP(req), req.UserAgent(), req.Referer())
+	rate := l.DownloadSampleRate
+	if rate > 1 {
+		rate = 1
+	}
+	entry := LogEntry{
+		"type":        "download",
+		"timestamp":   time.Now().UTC().Format(time.RFC3339),
+		"ip":          ip,
+		"user_agent":  userAgent,
+		"referer":     referer,
+		"id":          idext,
+		"method":      req.Method,
+		"status":      status,
+		"bytes":       bytes,
+		"range":       req.Header.Get("Range"),
+		"sample_rate": rate,
+	}
+	if view != "" {
+		entry["view"] = view
+	}
+	l.Log(withKeyId(keyId, entry))
+}
+
+// anonymize blanks or hashes the request information according to the
+// logging options; keyId identifies the HMAC key if anything was hashed with
+// one; without a key or a legacy salt, values that would be hashed are
+// blanked, since unsalted SHA-1 hashes of IP addresses are easily reversed
+func (l *Logger) anonymize(ip, userAgent, referer string) (string, string, string, string) {
+	key, keyId := l.hashKey(time.Now())
+	canHash := key != nil || l.HashSalt != ""
+	hashed := false
+	if !l.LogIP || (l.HashIP && !canHash) {
 		ip = ""
 	} else if l.HashIP {
-		ip = l.hash(ip)
+		ip, hashed = l.hash(key, ip), true
 	}
-	if !l.LogUserAgent {
+	if !l.LogUserAgent || (l.HashUserAgent && !canHash) {
 		userAgent = ""
 	} else if l.HashUserAgent {
-		userAgent = l.hash(userAgent)
+		userAgent, hashed = l.hash(key, userAgent), true
 	}
-	if !l.LogReferer {
+	if !l.LogReferer || (l.HashReferer && !canHash) {
 		referer = ""
 	} else if l.HashReferer {
-		referer = l.hash(referer)
+		referer, hashed = l.hash(key, referer), true
 	}
-	l.Log(LogEntry{
-		"type":       "upload",
+	if !hashed {
+		keyId = ""
+	}
+	return ip, userAgent, referer, keyId
+}
+
+func withKeyId(keyId string, entry LogEntry) LogEntry {
+	if keyId != "" {
+		entry["key_id"] = keyId
+	}
+	return entry
+}
+
+// countingResponseWriter records the status and body size of a response
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *countingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// LogAdmin records an action taken in the admin interface; the IP address is
+// always logged unhashed
+func (l *Logger) LogAdmin(req *http.Request, action, target string, err error) {
+	entry := LogEntry{
+		"type":       "admin",
 		"timestamp":  time.Now().UTC().Format(time.RFC3339),
-		"ip":         ip,
-		"user_agent": userAgent,
-		"referer":    referer,
-		"orig_name":  origName,
-		"id":         idext,
-		"hash":       hash,
-		"size":       size,
-	})
+		"ip":         l.clientIP(req),
+		"user_agent": req.UserAgent(),
+		"action":     action,
+		"target":     target,
+	}
+	if err != nil {
+		entry["error"] = err.Error()
+	}
+	l.Log(entry)
+}
+
+// hashKey returns the HMAC key for hashing entries logged at t and its ID,
+// which is the start of the SHA-256 hash of HashKey followed by the date if
+// the key is rotated daily; it returns nil if no HashKey is set
+func (l *Logger) hashKey(t time.Time) (key []byte, id string) {
+	if l.HashKey == nil {
+		return nil, ""
+	}
+	id = hashKeyFingerprint(l.HashKey)
+	if !l.HashKeyRotate {
+		return l.HashKey, id
+	}
+	date := t.UTC().Format("2006-01-02")
+	return dailyHashKey(l.HashKey, date), id + "-" + date
+}
+
+func hashKeyFingerprint(key []byte) string {
+	fp := sha256.Sum256(key)
+	return hex.EncodeToString(fp[:4])
+}
+
+func dailyHashKey(key []byte, date string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("gomf log hash key " + date))
+	return mac.Sum(nil)
 }
 
-func (l *Logger) hash(s string) string {
+// hash hashes s with an HMAC key, or with the legacy salted SHA-1 if key is
+// nil
+func (l *Logger) hash(key []byte, s string) string {
+	if key != nil {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(s))
+		return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
 	h := sha1.New()
 	h.Write([]byte(l.HashSalt))
 	h.Write([]byte(s))
@@ -115,27 +283,46 @@ func (l *Logger) hash(s string) string {
 	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
 }
 
-func (l *Logger) getLogFile() (*os.File, error) {
-	if l.lastDate == "" {
-		if err := os.MkdirAll(l.LogDir, 0755); err != nil {
-			return nil, err
-		}
+// HashWithKeyId hashes s the way it would have been hashed in entries with
+// the given key ID, so entries about a specific value can be found
+func (l *Logger) HashWithKeyId(s, keyId string) (string, error) {
+	if keyId == "" {
+		return l.hash(nil, s), nil
 	}
-	currentDate := time.Now().UTC().Format("2006-01-02")
-	if l.lastDate == currentDate {
-		return l.logFile, nil
+	if l.HashKey == nil {
+		return "", errors.New("no log hash key configured")
 	}
-	f, err := os.OpenFile(path.Join(l.LogDir, currentDate+".log.json"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
-	if err != nil {
-		return f, err
+	key, id := l.HashKey, keyId
+	if i := strings.IndexByte(keyId, '-'); i >= 0 {
+		key, id = dailyHashKey(l.HashKey, keyId[i+1:]), keyId[:i]
 	}
-	if l.logFile != nil {
-		l.logFile.Close()
+	if id != hashKeyFingerprint(l.HashKey) {
+		return "", errors.New("key ID " + keyId + " does not match the configured log hash key")
 	}
-	l.lastDate = currentDate
-	l.logFile = f
-	l.encoder = json.NewEncoder(f)
-	return f, nil
+	return l.hash(key, s), nil
+}
+
+// LoadHashKey reads an HMAC key for hashed log entries from a file; if the
+// file does not exist, it is created with a random key
+func LoadHashKey(fname string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		key := make([]byte, 32)
+		if _, err = crand.Read(key); err != nil {
+			return nil, err
+		}
+		data = []byte(hex.EncodeToString(key) + "\n")
+		if err = ioutil.WriteFile(fname, data, 0600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) == 0 {
+		return nil, errors.New("empty log hash key in " + fname)
+	}
+	return key, nil
 }
 
 var DefaultLogger = InitLogger("log")
@@ -151,3 +338,46 @@ func LogUpload(req *http.Request, res result) {
 		DefaultLogger.LogUpload(req, res)
 	}
 }
+
+func LogLink(req *http.Request, id, target string) {
+	if DefaultLogger != nil {
+		DefaultLogger.LogLink(req, id, target)
+	}
+}
+
+// withDownloadLog wraps h to log a sample of its requests as downloads and
+// count them in the metrics
+func withDownloadLog(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l := DefaultLogger
+		logged := l != nil && l.SampleDownload()
+		if !logged && !metricsEnabled {
+			h(w, r)
+			return
+		}
+		cw := &countingResponseWriter{ResponseWriter: w}
+		h(cw, r)
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		if metricsEnabled {
+			observeDownload(cw.status, cw.bytes)
+		}
+		if logged {
+			// thumbnails and other views are logged with the ID of their file
+			id, view := strings.TrimLeft(r.URL.Path, "/"), ""
+			if i := strings.Index(id, "/"); i >= 0 {
+				id, view = id[:i], id[i+1:]
+			}
+			l.LogDownload(r, id, view, cw.status, cw.bytes)
+		}
+	}
+}
+
+var AuditLogger = InitLogger(path.Join("log", "audit"))
+
+func LogAdmin(req *http.Request, action, target string, err error) {
+	if AuditLogger != nil {
+		AuditLogger.LogAdmin(req, action, target, err)
+	}
+}
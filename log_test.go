@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestLoadHashKey(t *testing.T) {
+	dir := setupTest(t)
+	fname := path.Join(dir, "log-hash.key")
+	key, err := LoadHashKey(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{64}$`).Match(key) {
+		t.Errorf("created key %q", key)
+	}
+	if stat, err := os.Stat(fname); err != nil || stat.Mode().Perm() != 0600 {
+		t.Errorf("key file: %v, %v", stat, err)
+	}
+	if again, err := LoadHashKey(fname); err != nil || !bytes.Equal(again, key) {
+		t.Errorf("reloaded key %q (%v), want %q", again, err, key)
+	}
+
+	empty := path.Join(dir, "empty.key")
+	if err = ioutil.WriteFile(empty, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadHashKey(empty); err == nil {
+		t.Error("empty key file was accepted")
+	}
+}
+
+func TestHashWithKeyId(t *testing.T) {
+	day1 := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+	value := "192.0.2.1"
+
+	l := &Logger{HashKey: []byte("secret")}
+	key1, id1 := l.hashKey(day1)
+	key2, id2 := l.hashKey(day2)
+	if !bytes.Equal(key1, key2) || id1 != id2 || id1 != hashKeyFingerprint(l.HashKey) {
+		t.Errorf("unrotated keys differ by day: %s, %s", id1, id2)
+	}
+	if hash, err := l.HashWithKeyId(value, id1); err != nil || hash != l.hash(key1, value) {
+		t.Errorf("HashWithKeyId(%s) = %q, %v", id1, hash, err)
+	}
+
+	l.HashKeyRotate = true
+	key1, id1 = l.hashKey(day1)
+	key2, id2 = l.hashKey(day2)
+	if bytes.Equal(key1, key2) || id1 != hashKeyFingerprint(l.HashKey)+"-2024-01-01" || id2 != hashKeyFingerprint(l.HashKey)+"-2024-01-02" {
+		t.Errorf("rotated key IDs %s, %s", id1, id2)
+	}
+	if l.hash(key1, value) == l.hash(key2, value) {
+		t.Error("hashes can be linked across days")
+	}
+	for _, k := range []struct {
+		key []byte
+		id  string
+	}{{key1, id1}, {key2, id2}} {
+		if hash, err := l.HashWithKeyId(value, k.id); err != nil || hash != l.hash(k.key, value) {
+			t.Errorf("HashWithKeyId(%s) = %q, %v", k.id, hash, err)
+		}
+	}
+
+	other := &Logger{HashKey: []byte("other secret")}
+	if _, err := other.HashWithKeyId(value, id1); err == nil {
+		t.Error("key ID of a different key was accepted")
+	}
+	if _, err := (&Logger{}).HashWithKeyId(value, id1); err == nil {
+		t.Error("key ID was accepted without a key")
+	}
+
+	// entries without a key ID were hashed with the legacy salted SHA-1
+	legacy := &Logger{HashKey: []byte("secret"), HashSalt: "salt"}
+	hash, err := legacy.HashWithKeyId(value, "")
+	if err != nil || hash != legacy.hash(nil, value) || hash == (&Logger{HashSalt: "pepper"}).hash(nil, value) {
+		t.Errorf("legacy hash %q, %v", hash, err)
+	}
+}
+
+func TestAnonymize(t *testing.T) {
+	const ip, ua = "192.0.2.1", "curl/8.0"
+	tests := []struct {
+		name   string
+		logger *Logger
+		ip     bool // the IP address is logged hashed
+		keyId  bool
+	}{
+		{"key", &Logger{HashKey: []byte("secret")}, true, true},
+		{"rotated key", &Logger{HashKey: []byte("secret"), HashKeyRotate: true}, true, true},
+		{"legacy salt", &Logger{HashSalt: "salt"}, true, false},
+		{"no key or salt", &Logger{}, false, false},
+	}
+	for _, test := range tests {
+		l := test.logger
+		l.LogIP, l.HashIP, l.LogUserAgent = true, true, true
+		gotIp, gotUa, _, keyId := l.anonymize(ip, ua, "")
+		if test.ip && (gotIp == "" || gotIp == ip) {
+			t.Errorf("%s: logged IP %q, want a hash", test.name, gotIp)
+		} else if !test.ip && gotIp != "" {
+			t.Errorf("%s: logged IP %q, want none", test.name, gotIp)
+		}
+		if gotUa != ua {
+			t.Errorf("%s: logged User-Agent %q, want %q", test.name, gotUa, ua)
+		}
+		if (keyId != "") != test.keyId {
+			t.Errorf("%s: key ID %q", test.name, keyId)
+		}
+		if keyId != "" {
+			if hash, err := l.HashWithKeyId(ip, keyId); err != nil || hash != gotIp {
+				t.Errorf("%s: HashWithKeyId = %q, %v, want %q", test.name, hash, err, gotIp)
+			}
+		}
+
+		l.LogIP = false
+		if gotIp, _, _, keyId = l.anonymize(ip, ua, ""); gotIp != "" || keyId != "" {
+			t.Errorf("%s: logged IP %q with key ID %q without LogIP", test.name, gotIp, keyId)
+		}
+	}
+}
+
+// entrySink keeps the entries written to it
+type entrySink struct {
+	entries []LogEntry
+}
+
+func (s *entrySink) WriteEntry(entry LogEntry) error {
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+func TestDownloadSampleRate(t *testing.T) {
+	const n = 4000
+	tests := []struct {
+		enabled  bool
+		rate     float64
+		min, max int
+	}{
+		{true, 1, n, n},
+		{true, 2, n, n},
+		{true, 0, 0, 0},
+		{true, 0.25, n/4 - n/20, n/4 + n/20},
+		{false, 1, 0, 0},
+	}
+	for _, test := range tests {
+		l := &Logger{LogDownloads: test.enabled, DownloadSampleRate: test.rate}
+		sampled := 0
+		for i := 0; i < n; i++ {
+			if l.SampleDownload() {
+				sampled++
+			}
+		}
+		if sampled < test.min || sampled > test.max {
+			t.Errorf("enabled %v, rate %v: sampled %d of %d downloads, want %d to %d", test.enabled, test.rate, sampled, n, test.min, test.max)
+		}
+	}
+
+	// entries record the rate, at most 1
+	sink := &entrySink{}
+	l := &Logger{Sinks: []LogSink{sink}, LogDownloads: true, DownloadSampleRate: 2}
+	l.LogDownload(httptest.NewRequest("GET", "/abc.txt", nil), "abc.txt", "", http.StatusOK, 3)
+	if len(sink.entries) != 1 || sink.entries[0]["sample_rate"] != 1.0 {
+		t.Errorf("logged %v", sink.entries)
+	}
+}
+
+func TestDownloadLogId(t *testing.T) {
+	setupTest(t)
+	sink := &entrySink{}
+	DefaultLogger = &Logger{Sinks: []LogSink{sink}, LogDownloads: true, DownloadSampleRate: 1}
+	handler := withDownloadLog(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "data")
+	})
+	tests := []struct {
+		path, id, view string
+	}{
+		{"/abc.png", "abc.png", ""},
+		{"/abc.png/thumb", "abc.png", "thumb"},
+		{"/abc.txt/view", "abc.txt", "view"},
+	}
+	for _, test := range tests {
+		sink.entries = nil
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", test.path, nil))
+		if len(sink.entries) != 1 {
+			t.Errorf("%s: logged %d entries", test.path, len(sink.entries))
+			continue
+		}
+		entry := sink.entries[0]
+		if view, _ := entry["view"].(string); entry["id"] != test.id || view != test.view || entry["bytes"] != int64(4) {
+			t.Errorf("%s: logged %v, want ID %q and view %q", test.path, entry, test.id, test.view)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const logsUsage = `usage: gomf [options] logs [-json] [-dir DIR] [-since TIME] [-until TIME]
+	[-type TYPE] [-id ID] [-hash HASH] [-ip IP]
+
+prints log entries matching all of the given filters; TIME is a duration
+(e.g. 24h) or a date (2006-01-02 or RFC 3339); IP is matched against raw IP
+addresses and against hashed ones using the -log-hash-key, -log-hash-rotate
+or -log-hash-salt options
+`
+
+// logsDir is the default directory of the logs command, the directory of
+// the file sink configured with --log-sink
+var logsDir = "log"
+
+// readLogFile calls fn for each entry in a log file; compressed log files
+// are read if fname does not exist
+func readLogFile(fname string, fn func(line []byte, entry LogEntry) error) error {
+	var r io.Reader
+	f, err := os.Open(fname)
+	if os.IsNotExist(err) && !strings.HasSuffix(fname, ".gz") {
+		fname += ".gz"
+		f, err = os.Open(fname)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r = f
+	if strings.HasSuffix(fname, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		r = gz
+	}
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1024*1024)
+	for sc.Scan() {
+		var entry LogEntry
+		if err := json.Unmarshal(sc.Bytes(), &entry); err != nil {
+			continue
+		}
+		if err := fn(sc.Bytes(), entry); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+type logQuery struct {
+	since, until time.Time
+	typ, id      string
+	hash, ip     string
+	ipHashes     map[string]string // hashed IP by key ID
+}
+
+func (q *logQuery) match(entry LogEntry) bool {
+	str := func(key string) string {
+		s, _ := entry[key].(string)
+		return s
+	}
+	if q.typ != "" && str("type") != q.typ {
+		return false
+	}
+	if q.id != "" && trimExt(str("id")) != trimExt(q.id) {
+		return false
+	}
+	if q.hash != "" && str("hash") != q.hash {
+		return false
+	}
+	if !q.since.IsZero() || !q.until.IsZero() {
+		t, err := time.Parse(time.RFC3339, str("timestamp"))
+		if err != nil || t.Before(q.since) || (!q.until.IsZero() && t.After(q.until)) {
+			return false
+		}
+	}
+	if q.ip != "" && str("ip") != q.ip {
+		keyId := str("key_id")
+		hash, ok := q.ipHashes[keyId]
+		if !ok {
+			hash, _ = DefaultLogger.HashWithKeyId(q.ip, keyId)
+			q.ipHashes[keyId] = hash
+		}
+		if hash == "" || str("ip") != hash {
+			return false
+		}
+	}
+	return true
+}
+
+// sortLogFiles sorts log file names chronologically, by day and then by
+// rotation index; plain name order puts DATE.1.log.json before DATE.log.json
+func sortLogFiles(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		a, b := names[i], names[j]
+		if len(a) >= 10 && len(b) >= 10 && a[:10] != b[:10] {
+			return a[:10] < b[:10]
+		}
+		sa := logFileSeq(strings.TrimSuffix(a, ".gz"))
+		sb := logFileSeq(strings.TrimSuffix(b, ".gz"))
+		if sa != sb {
+			return sa < sb
+		}
+		return a < b
+	})
+}
+
+func runLogs(args []string) int {
+	cmd := newAdminCommand("logs")
+	cmd.flags.Usage = func() { fmt.Fprint(os.Stderr, logsUsage) }
+	dir := cmd.flags.String("dir", logsDir, "log directory")
+	sinceStr := cmd.flags.String("since", "", "only show entries logged after this time")
+	untilStr := cmd.flags.String("until", "", "only show entries logged before this time")
+	q := &logQuery{ipHashes: make(map[string]string)}
+	cmd.flags.StringVar(&q.typ, "type", "", "only show entries of this type (upload, download, ...)")
+	cmd.flags.StringVar(&q.id, "id", "", "only show entries about this ID")
+	cmd.flags.StringVar(&q.hash, "hash", "", "only show entries about this SHA-1 hash")
+	cmd.flags.StringVar(&q.ip, "ip", "", "only show entries from this IP address or its hash")
+	if err := cmd.flags.Parse(args); err != nil {
+		return 2
+	}
+	var err error
+	if *sinceStr != "" {
+		if q.since, err = parseTime(*sinceStr); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid time:", *sinceStr)
+			return 2
+		}
+	}
+	if *untilStr != "" {
+		if q.until, err = parseTime(*untilStr); err != nil {
+			fmt.Fprintln(os.Stderr, "invalid time:", *untilStr)
+			return 2
+		}
+	}
+	q.hash = strings.ToLower(q.hash)
+
+	files, err := ioutil.ReadDir(*dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var names []string
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasSuffix(name, ".log.json") || strings.HasSuffix(name, ".log.json.gz") {
+			names = append(names, name)
+		}
+	}
+	sortLogFiles(names)
+	entries := []LogEntry{}
+	for _, name := range names {
+		// log files are named after the UTC day their entries were logged
+		if len(name) >= 10 && ((!q.since.IsZero() && name[:10] < q.since.UTC().Format("2006-01-02")) ||
+			(!q.until.IsZero() && name[:10] > q.until.UTC().Format("2006-01-02"))) {
+			continue
+		}
+		err = readLogFile(path.Join(*dir, name), func(line []byte, entry LogEntry) error {
+			if q.match(entry) {
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+		}
+	}
+
+	cmd.output(entries, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "TIME\tTYPE\tID\tHASH\tSIZE\tIP\tNAME")
+		for _, e := range entries {
+			size := e["size"]
+			if size == nil {
+				size = e["bytes"]
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", field(e, "timestamp"), field(e, "type"), field(e, "id"), field(e, "hash"), orDash(size), field(e, "ip"), field(e, "orig_name"))
+		}
+	})
+	return 0
+}
+
+func trimExt(id string) string {
+	return strings.TrimSuffix(id, path.Ext(id))
+}
+
+func field(e LogEntry, key string) interface{} {
+	return orDash(e[key])
+}
+
+func orDash(v interface{}) interface{} {
+	if v == nil || v == "" {
+		return "-"
+	}
+	return v
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestSortLogFiles(t *testing.T) {
+	names := []string{
+		"2024-01-02.log.json",
+		"2024-01-01.10.log.json",
+		"2024-01-01.2.log.json.gz",
+		"2024-01-01.1.log.json.gz",
+		"2024-01-01.log.json.gz",
+	}
+	sortLogFiles(names)
+	want := []string{
+		"2024-01-01.log.json.gz",
+		"2024-01-01.1.log.json.gz",
+		"2024-01-01.2.log.json.gz",
+		"2024-01-01.10.log.json",
+		"2024-01-02.log.json",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("sorted %q, want %q", names, want)
+	}
+}
+
+func TestLogSinkDir(t *testing.T) {
+	tests := []struct {
+		specs, dir string
+	}{
+		{"file", "log"},
+		{"file:", "log"},
+		{"stdout", "log"},
+		{"stderr, file:/var/log/gomf", "/var/log/gomf"},
+		{"syslog:udp:localhost:514,file:a,file:b", "a"},
+	}
+	for _, test := range tests {
+		if dir := logSinkDir(test.specs, "log"); dir != test.dir {
+			t.Errorf("logSinkDir(%q) = %q, want %q", test.specs, dir, test.dir)
+		}
+	}
+}
+
+func TestRunLogs(t *testing.T) {
+	dir := setupTest(t)
+	logDir := path.Join(dir, "custom-log")
+	if err := os.Mkdir(logDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := []struct {
+		name string
+		ids  []string
+	}{
+		{"2024-01-01.log.json.gz", []string{"a", "b"}},
+		{"2024-01-01.1.log.json", []string{"c"}},
+		{"2024-01-01.2.log.json", []string{"d"}},
+		{"2024-01-02.log.json", []string{"e"}},
+		{"other.txt", []string{"x"}},
+	}
+	for _, file := range files {
+		var buf bytes.Buffer
+		for _, id := range file.ids {
+			json.NewEncoder(&buf).Encode(LogEntry{"type": "upload", "id": id})
+		}
+		data := buf.Bytes()
+		if path.Ext(file.name) == ".gz" {
+			var gz bytes.Buffer
+			w := gzip.NewWriter(&gz)
+			w.Write(data)
+			w.Close()
+			data = gz.Bytes()
+		}
+		if err := ioutil.WriteFile(path.Join(logDir, file.name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the default directory is the one main takes from --log-sink
+	oldDir := logsDir
+	logsDir = logSinkDir("stdout,file:"+logDir, "log")
+	defer func() { logsDir = oldDir }()
+
+	out, err := ioutil.TempFile(dir, "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	code := runLogs([]string{"-json"})
+	os.Stdout = stdout
+	if code != 0 {
+		t.Fatalf("runLogs returned %d", code)
+	}
+
+	out.Seek(0, 0)
+	var entries []LogEntry
+	if err := json.NewDecoder(out).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, entry := range entries {
+		ids = append(ids, entry["id"].(string))
+	}
+	if want := []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got entries %q, want %q", ids, want)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const logMaintenanceInterval = time.Hour
+
+// StartMaintenance starts a background task that compresses closed log
+// files and removes log files older than the retention period
+func (s *FileSink) StartMaintenance() {
+	if s.RetentionDays <= 0 && !s.Compress {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(logMaintenanceInterval)
+		defer ticker.Stop()
+		for {
+			if err := s.maintain(); err != nil {
+				fmt.Fprintf(os.Stderr, "error maintaining logs: %s\n", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-s.closed:
+			}
+		}
+	}()
+}
+
+// maintain compresses and removes log files; the sink is locked during the
+// pass, so the current log file cannot be rotated while files are compressed
+func (s *FileSink) maintain() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	files, err := ioutil.ReadDir(s.Dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	current := ""
+	if s.logFile != nil {
+		current = path.Base(s.logFile.Name())
+	}
+	cutoff := time.Now().UTC().AddDate(0, 0, -s.RetentionDays).Format("2006-01-02")
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !(strings.HasSuffix(name, ".log.json") || strings.HasSuffix(name, ".log.json.gz")) {
+			continue
+		}
+		fpath := path.Join(s.Dir, name)
+		if s.RetentionDays > 0 && len(name) >= 10 && name[:10] < cutoff {
+			if err = os.Remove(fpath); err != nil {
+				return err
+			}
+		} else if s.Compress && strings.HasSuffix(name, ".log.json") && logFileClosed(name, current) {
+			if err = compressLogFile(fpath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// logFileClosed reports whether a log file will not be written to anymore
+// given the name of the current log file
+func logFileClosed(name, current string) bool {
+	if len(name) < 10 || name[:10] < time.Now().UTC().Format("2006-01-02") {
+		return true
+	}
+	// files of the current day before the current one were rotated by size
+	return current != "" && name[:10] == current[:10] && logFileSeq(name) < logFileSeq(current)
+}
+
+func logFileSeq(name string) int {
+	name = strings.TrimSuffix(name, ".log.json")
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		seq, _ := strconv.Atoi(name[i+1:])
+		return seq
+	}
+	return 0
+}
+
+func compressLogFile(fpath string) error {
+	in, err := os.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(fpath+".gz.tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	gz.Name = path.Base(fpath)
+	if _, err = io.Copy(gz, in); err == nil {
+		err = gz.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fpath+".gz.tmp", fpath+".gz")
+	}
+	if err != nil {
+		os.Remove(fpath + ".gz.tmp")
+		return err
+	}
+	return os.Remove(fpath)
+}
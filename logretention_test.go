@@ -0,0 +1,107 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestLogFileClosed(t *testing.T) {
+	today := time.Now().UTC().Format("2006-01-02")
+	yesterday := time.Now().UTC().AddDate(0, 0, -1).Format("2006-01-02")
+	tests := []struct {
+		name, current string
+		closed        bool
+	}{
+		{yesterday + ".log.json", today + ".log.json", true},
+		{yesterday + ".3.log.json", "", true},
+		{today + ".log.json", today + ".log.json", false},
+		{today + ".log.json", today + ".1.log.json", true},
+		{today + ".2.log.json", today + ".10.log.json", true},
+		{today + ".10.log.json", today + ".2.log.json", false},
+		{today + ".log.json", "", false},
+	}
+	for _, test := range tests {
+		if closed := logFileClosed(test.name, test.current); closed != test.closed {
+			t.Errorf("logFileClosed(%q, %q) = %v, want %v", test.name, test.current, closed, test.closed)
+		}
+	}
+}
+
+func TestLogMaintenance(t *testing.T) {
+	dir := setupTest(t)
+	logDir := path.Join(dir, "log")
+	if err := os.Mkdir(logDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	today := now.Format("2006-01-02")
+	recent := now.AddDate(0, 0, -2).Format("2006-01-02")
+	old := now.AddDate(0, 0, -10).Format("2006-01-02")
+	files := map[string]string{
+		old + ".log.json":        "old\n",
+		old + ".1.log.json.gz":   "old compressed\n",
+		recent + ".log.json":     "recent\n",
+		today + ".log.json":      "rotated by size\n",
+		"other.txt":              "not a log\n",
+		old + ".other.log.jsonx": "not a log\n",
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(path.Join(logDir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := NewFileSink(logDir)
+	s.RetentionDays, s.Compress, s.MaxFileSize = 7, true, 10
+	// the first file of today is full, so a second one is started
+	if err := s.WriteEntry(LogEntry{"id": "current"}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.logFile.Close()
+	if err := s.maintain(); err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]bool{}
+	list, _ := ioutil.ReadDir(logDir)
+	for _, fi := range list {
+		names[fi.Name()] = true
+	}
+	want := []string{recent + ".log.json.gz", today + ".log.json.gz", today + ".1.log.json", "other.txt", old + ".other.log.jsonx"}
+	for _, name := range want {
+		if !names[name] {
+			t.Errorf("%s is missing", name)
+		}
+	}
+	if len(names) != len(want) {
+		t.Errorf("log folder contains %v, want %v", names, want)
+	}
+
+	for name, contents := range map[string]string{recent + ".log.json.gz": "recent\n", today + ".log.json.gz": "rotated by size\n"} {
+		f, err := os.Open(path.Join(logDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		data, err := ioutil.ReadAll(gz)
+		f.Close()
+		if err != nil || string(data) != contents {
+			t.Errorf("%s contains %q (%v), want %q", name, data, err, contents)
+		}
+	}
+
+	// the current file is still written to after the maintenance pass
+	if err := s.WriteEntry(LogEntry{"id": "after"}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(path.Join(logDir, today+".1.log.json")); len(data) == 0 {
+		t.Error("current log file is empty")
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogSink is a destination for log entries
+type LogSink interface {
+	WriteEntry(entry LogEntry) error
+}
+
+// logSinkDir returns the directory of the first file sink in a
+// comma-separated list of sink specifications, or dir if there is none
+func logSinkDir(specs, dir string) string {
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "file" {
+			return dir
+		}
+		if strings.HasPrefix(spec, "file:") && spec != "file:" {
+			return spec[len("file:"):]
+		}
+	}
+	return dir
+}
+
+// ParseLogSink creates a sink from a specification:
+//
+//	file[:DIR]                  JSON lines in daily files in DIR (default dir)
+//	stdout, stderr              JSON lines on standard output or error
+//	syslog[:unix:PATH]          RFC 5424 syslog over a Unix socket (/dev/log)
+//	syslog:udp:HOST:PORT        RFC 5424 syslog over UDP
+//	syslog:tcp:HOST:PORT        RFC 5424 syslog over TCP
+//	journald[:PATH]             the systemd journal's native protocol
+func ParseLogSink(spec, dir string) (LogSink, error) {
+	kind, arg := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	switch kind {
+	case "file":
+		if arg != "" {
+			dir = arg
+		}
+		return NewFileSink(dir), nil
+	case "stdout":
+		return NewStreamSink(os.Stdout), nil
+	case "stderr":
+		return NewStreamSink(os.Stderr), nil
+	case "syslog":
+		network, addr := "unix", "/dev/log"
+		if arg != "" {
+			i := strings.IndexByte(arg, ':')
+			if i < 0 {
+				return nil, errors.New("invalid syslog address: " + arg)
+			}
+			network, addr = arg[:i], arg[i+1:]
+			if network != "unix" && network != "udp" && network != "tcp" {
+				return nil, errors.New("invalid syslog network: " + network)
+			}
+		}
+		return NewSyslogSink(network, addr), nil
+	case "journald":
+		if arg == "" {
+			arg = "/run/systemd/journal/socket"
+		}
+		return &JournaldSink{Socket: arg}, nil
+	}
+	return nil, errors.New("unknown log sink: " + spec)
+}
+
+// FileSink writes JSON lines to a file per UTC day in a directory
+type FileSink struct {
+	Dir string
+	// RetentionDays is the number of days logs are kept for, 0 keeps them
+	// forever; Compress gzips log files once they are closed; a new file is
+	// started within a day once the current one exceeds MaxFileSize bytes
+	RetentionDays int
+	Compress      bool
+	MaxFileSize   int64
+	logFile       *logFile
+	encoder       *json.Encoder
+	lastDate      string
+	lastSeq       int
+	lock          sync.Mutex
+	closed        chan struct{}
+}
+
+// logFile counts the bytes written to a log file for size-based rotation
+type logFile struct {
+	*os.File
+	size int64
+}
+
+func (f *logFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func NewFileSink(dir string) *FileSink {
+	return &FileSink{
+		Dir:    dir,
+		closed: make(chan struct{}, 1),
+	}
+}
+
+func (s *FileSink) WriteEntry(entry LogEntry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err := s.getLogFile(); err != nil {
+		return fmt.Errorf("error opening log file: %s", err)
+	}
+	return s.encoder.Encode(entry)
+}
+
+func (s *FileSink) getLogFile() (*logFile, error) {
+	if s.lastDate == "" {
+		if err := os.MkdirAll(s.Dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	currentDate := time.Now().UTC().Format("2006-01-02")
+	seq := 0
+	if s.lastDate == currentDate {
+		if s.MaxFileSize <= 0 || s.logFile.size < s.MaxFileSize {
+			return s.logFile, nil
+		}
+		seq = s.lastSeq + 1
+	}
+	var f *logFile
+	for ; ; seq++ {
+		fname := path.Join(s.Dir, logFileName(currentDate, seq))
+		if _, err := os.Stat(fname + ".gz"); err == nil {
+			continue
+		}
+		file, err := os.OpenFile(fname, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		stat, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		f = &logFile{File: file, size: stat.Size()}
+		if s.MaxFileSize <= 0 || f.size < s.MaxFileSize {
+			break
+		}
+		file.Close()
+	}
+	if s.logFile != nil {
+		s.logFile.Close()
+		select {
+		case s.closed <- struct{}{}:
+		default:
+		}
+	}
+	s.lastDate = currentDate
+	s.lastSeq = seq
+	s.logFile = f
+	s.encoder = json.NewEncoder(f)
+	return f, nil
+}
+
+// logFileName returns the name of the seq-th log file of a day
+func logFileName(date string, seq int) string {
+	if seq == 0 {
+		return date + ".log.json"
+	}
+	return date + "." + strconv.Itoa(seq) + ".log.json"
+}
+
+// StreamSink writes JSON lines to a stream such as standard output
+type StreamSink struct {
+	encoder *json.Encoder
+}
+
+func NewStreamSink(w io.Writer) *StreamSink {
+	return &StreamSink{encoder: json.NewEncoder(w)}
+}
+
+func (s *StreamSink) WriteEntry(entry LogEntry) error {
+	return s.encoder.Encode(entry)
+}
+
+const (
+	syslogFacility = 3 // daemon
+	syslogSeverity = 6 // informational
+
+	// sinks are written while holding the logger's lock, so writes to
+	// remote sinks time out instead of blocking all requests
+	sinkWriteTimeout = 5 * time.Second
+)
+
+// SyslogSink sends entries as JSON messages in the RFC 5424 format; messages
+// over TCP are framed by octet counting (RFC 6587)
+type SyslogSink struct {
+	Network  string // "unix", "udp" or "tcp"
+	Address  string
+	Hostname string
+	conn     net.Conn
+}
+
+func NewSyslogSink(network, address string) *SyslogSink {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	return &SyslogSink{Network: network, Address: address, Hostname: hostname}
+}
+
+func (s *SyslogSink) dial() (err error) {
+	if s.Network == "unix" {
+		if s.conn, err = net.Dial("unixgram", s.Address); err == nil {
+			return
+		}
+	}
+	s.conn, err = net.DialTimeout(s.Network, s.Address, 5*time.Second)
+	return
+}
+
+func (s *SyslogSink) WriteEntry(entry LogEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	msgid, _ := entry["type"].(string)
+	if msgid == "" {
+		msgid = "-"
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s gomf %d %s - %s",
+		syslogFacility*8+syslogSeverity,
+		time.Now().UTC().Format("2006-01-02T15:04:05.000000Z"),
+		s.Hostname, os.Getpid(), msgid, data)
+	if s.Network == "tcp" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+
+	// reconnect once if the connection was lost
+	for i := 0; ; i++ {
+		if s.conn == nil {
+			if err = s.dial(); err != nil {
+				return err
+			}
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(sinkWriteTimeout))
+		if _, err = io.WriteString(s.conn, msg); err == nil || i > 0 {
+			return err
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// JournaldSink sends entries to the systemd journal; the JSON entry is the
+// message and each of its fields is also a GOMF_ journal field
+type JournaldSink struct {
+	Socket string
+	conn   net.Conn
+}
+
+func (s *JournaldSink) WriteEntry(entry LogEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	journalField(&buf, "MESSAGE", string(data))
+	journalField(&buf, "PRIORITY", strconv.Itoa(syslogSeverity))
+	journalField(&buf, "SYSLOG_IDENTIFIER", "gomf")
+	for k, v := range entry {
+		journalField(&buf, "GOMF_"+journalFieldName(k), fmt.Sprint(v))
+	}
+
+	// reconnect once if journald was restarted
+	for i := 0; ; i++ {
+		if s.conn == nil {
+			if s.conn, err = net.Dial("unixgram", s.Socket); err != nil {
+				return err
+			}
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(sinkWriteTimeout))
+		if _, err = s.conn.Write(buf.Bytes()); err == nil || i > 0 {
+			return err
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// journalField writes a field in the journal's native protocol, using the
+// binary format if the value contains a newline
+func journalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+func journalFieldName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// syslogRe matches an RFC 5424 message from gomf with a JSON message
+var syslogRe = regexp.MustCompile(`^<30>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}Z (\S+) gomf (\d+) (\S+) - (\{.*\})$`)
+
+func checkSyslogMessage(t *testing.T, msg string, msgid string, entry LogEntry) {
+	m := syslogRe.FindStringSubmatch(msg)
+	if m == nil {
+		t.Errorf("invalid syslog message %q", msg)
+		return
+	}
+	if m[1] != "test-host" || m[2] != strconv.Itoa(os.Getpid()) || m[3] != msgid {
+		t.Errorf("syslog header of %q", msg)
+	}
+	var got LogEntry
+	if err := json.Unmarshal([]byte(m[4]), &got); err != nil {
+		t.Errorf("invalid JSON in %q: %s", msg, err)
+	} else if got["id"] != entry["id"] {
+		t.Errorf("got entry %v, want %v", got, entry)
+	}
+}
+
+func TestSyslogSinkTcp(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	sink := NewSyslogSink("tcp", ln.Addr().String())
+	sink.Hostname = "test-host"
+	// the message contains a newline, which octet counting allows
+	entries := []LogEntry{{"type": "upload", "id": "abc.txt"}, {"id": "line\nbreak"}}
+	go func() {
+		for _, entry := range entries {
+			if err := sink.WriteEntry(entry); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for i, msgid := range []string{"upload", "-"} {
+		length, err := r.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			t.Fatalf("invalid octet count %q", length)
+		}
+		msg := make([]byte, n)
+		if _, err = io.ReadFull(r, msg); err != nil {
+			t.Fatal(err)
+		}
+		checkSyslogMessage(t, string(msg), msgid, entries[i])
+	}
+}
+
+func TestSyslogSinkUdp(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	sink := NewSyslogSink("udp", pc.LocalAddr().String())
+	sink.Hostname = "test-host"
+	entry := LogEntry{"type": "download", "id": "abc.txt"}
+	if err = sink.WriteEntry(entry); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4096)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// datagrams are not framed
+	checkSyslogMessage(t, string(buf[:n]), "download", entry)
+}
+
+func TestJournalField(t *testing.T) {
+	long := func(name, value string) string {
+		var size [8]byte
+		binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+		return name + "\n" + string(size[:]) + value + "\n"
+	}
+	tests := []struct {
+		name, value, want string
+	}{
+		{"MESSAGE", "hello", "MESSAGE=hello\n"},
+		{"GOMF_ID", "", "GOMF_ID=\n"},
+		{"GOMF_NAME", "a=b", "GOMF_NAME=a=b\n"},
+		{"MESSAGE", "two\nlines", long("MESSAGE", "two\nlines")},
+		{"MESSAGE", "\n", long("MESSAGE", "\n")},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		journalField(&buf, test.name, test.value)
+		if buf.String() != test.want {
+			t.Errorf("journalField(%q, %q) = %q, want %q", test.name, test.value, buf.String(), test.want)
+		}
+	}
+
+	names := map[string]string{
+		"id":         "ID",
+		"user_agent": "USER_AGENT",
+		"key-id.2":   "KEY_ID_2",
+		"ünicode":    "_NICODE",
+	}
+	for key, want := range names {
+		if got := journalFieldName(key); got != want {
+			t.Errorf("journalFieldName(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestJournaldSinkReconnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "journal.socket")
+	listen := func() net.PacketConn {
+		pc, err := net.ListenPacket("unixgram", socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pc
+	}
+	read := func(pc net.PacketConn) string {
+		buf := make([]byte, 4096)
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+
+	sink := &JournaldSink{Socket: socket}
+	pc := listen()
+	if err = sink.WriteEntry(LogEntry{"id": "first"}); err != nil {
+		t.Fatal(err)
+	}
+	if msg := read(pc); !strings.Contains(msg, "GOMF_ID=first\n") || !strings.Contains(msg, "SYSLOG_IDENTIFIER=gomf\n") {
+		t.Errorf("journal message %q", msg)
+	}
+
+	// journald restarts with a new socket at the same path
+	pc.Close()
+	os.Remove(socket)
+	pc = listen()
+	defer pc.Close()
+	if err = sink.WriteEntry(LogEntry{"id": "second"}); err != nil {
+		t.Fatalf("after restart: %s", err)
+	}
+	if msg := read(pc); !strings.Contains(msg, "GOMF_ID=second\n") {
+		t.Errorf("journal message %q after restart", msg)
+	}
+}
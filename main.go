@@ -6,6 +6,8 @@ import (
 	"git.clsr.net/gomf/storage"
 	"math/rand"
 	"net/http"
+	"os"
+	"path"
 	"strings"
 	"time"
 )
@@ -23,9 +25,23 @@ var (
 	allowHtml     bool
 	cors          bool
 	redirectHttps bool
+	stripMetadata bool
 )
 
 func handle(w http.ResponseWriter, r *http.Request) {
+	if metricsEnabled {
+		start := time.Now()
+		route := routeOf(r)
+		for _, host := range strings.Split(uploadHost, ",") {
+			if r.Host == host {
+				route = "upload-host"
+			}
+		}
+		if r.Method == http.MethodPut {
+			route = "PUT"
+		}
+		defer func() { requestDuration.observe(route, time.Since(start).Seconds()) }()
+	}
 	if cors {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 	}
@@ -39,16 +55,20 @@ func handle(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, targ.String(), http.StatusFound)
 		return
 	}
-	if r.Method == http.MethodGet || r.Method == http.MethodPost || r.Method == http.MethodHead {
+	if (r.Method == http.MethodDelete || r.Method == http.MethodPut) && strings.HasPrefix(r.URL.Path, apiPrefix+"/") {
+		http.DefaultServeMux.ServeHTTP(w, r)
+	} else if r.Method == http.MethodGet || r.Method == http.MethodPost || r.Method == http.MethodHead {
 		for _, host := range strings.Split(uploadHost, ",") {
 			if r.Host == host {
-				handleFile(w, r)
+				withDownloadLog(handleFile)(w, r)
 				return
 			}
 		}
 		http.DefaultServeMux.ServeHTTP(w, r)
+	} else if r.Method == http.MethodPut {
+		handleRawUpload(w, r)
 	} else {
-		w.Header().Set("Allow", "POST, HEAD, OPTIONS, GET")
+		w.Header().Set("Allow", "POST, HEAD, OPTIONS, GET, PUT, DELETE")
 		if r.Method != http.MethodOptions {
 			http.Error(w, "The method is not allowed for the requested URL.", http.StatusMethodNotAllowed)
 		}
@@ -66,6 +86,16 @@ func main() {
 	flag.BoolVar(&allowHtml, "allow-html", false, "serve (X)HTML uploads with (X)HTML filetypes")
 	flag.BoolVar(&cors, "cors", false, "enable CORS and allow all origins")
 	flag.BoolVar(&redirectHttps, "redirect-https", false, "redirect HTTP traffic to HTTPS")
+	flag.BoolVar(&urlUpload, "url-upload", false, "allow uploading files from URLs fetched by the server")
+	flag.BoolVar(&fetchPrivate, "url-upload-private", false, "allow fetching URL uploads from private, loopback and link-local addresses")
+	flag.DurationVar(&fetchTimeout, "url-upload-timeout", fetchTimeout, "time limit for fetching a URL upload")
+	flag.IntVar(&fetchMaxRedirects, "url-upload-max-redirects", fetchMaxRedirects, "maximum number of redirects to follow when fetching a URL upload")
+	flag.Int64Var(&archiveMaxSize, "archive-max-size", archiveMaxSize, "maximum total size in bytes of the files in an archive download; 0 for no limit")
+	flag.IntVar(&archiveMaxFiles, "archive-max-files", archiveMaxFiles, "maximum number of files in an archive download")
+	flag.StringVar(&albumUrl, "album-url", "", "URL to serve albums from")
+	flag.BoolVar(&shortenEnabled, "shorten", false, "enable the /shorten URL shortener")
+	flag.StringVar(&shortUrl, "short-url", "", "URL to serve short links from")
+	flag.BoolVar(&stripMetadata, "strip-metadata", false, "strip EXIF, XMP and GPS metadata from uploaded images by default")
 	listenHttp := flag.String("http", "localhost:8080", "address to listen on for HTTP")
 	listenHttps := flag.String("https", "", "address to listen on for HTTPS")
 	cert := flag.String("cert", "", "path to TLS certificate (for HTTPS)")
@@ -84,15 +114,36 @@ func main() {
 	logUAHash := flag.Bool("log-ua-hash", false, "log hashed User-Agent headers")
 	logReferer := flag.Bool("log-referer", false, "log Referer headers")
 	logRefererHash := flag.Bool("log-referer-hash", false, "log hashed Referer headers")
-	logHashSalt := flag.String("log-hash-salt", "", "salt to use for hashed log entries")
+	logHashSalt := flag.String("log-hash-salt", "", "salt for legacy SHA-1 hashed log entries; only used without -log-hash-key")
+	logHashKey := flag.String("log-hash-key", "log-hash.key", "path to a file with the secret key for HMAC-hashed log entries; created with a random key if missing")
+	logHashRotate := flag.Bool("log-hash-rotate", false, "derive a new log hash key every day so hashes can only be linked within a day")
 	proxyCount := flag.Int("proxy-count", 0, "count of trusted reverse proxies")
+	logDownloads := flag.Bool("log-downloads", false, "log downloads of uploaded files")
+	logDownloadSample := flag.Float64("log-download-sample", 1, "fraction of downloads to log, between 0 and 1")
+	logRetention := flag.Int("log-retention-days", 0, "delete logs older than this many days; 0 to keep logs forever")
+	logCompress := flag.Bool("log-compress", false, "gzip log files once they are closed")
+	logMaxSize := flag.Int64("log-max-size", 0, "start a new log file once the current one exceeds this many bytes; 0 for one file per day")
+	flag.Int64Var(&minFreeSpace, "min-free-space", 0, "report not ready at /readyz when less than this many bytes are free on the storage disk; 0 to disable")
+	shutdownDelay := flag.Duration("shutdown-delay", 0, "time to report not ready at /readyz before shutting down on SIGINT or SIGTERM")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "time to wait for requests to finish when shutting down")
+	metrics := flag.Bool("metrics", false, "serve Prometheus metrics at /metrics")
+	metricsListen := flag.String("metrics-listen", "", "address to serve Prometheus metrics on instead of the main listeners, e.g. localhost:9100")
+	logSinks := flag.String("log-sink", "file", "comma-separated list of log destinations: file[:DIR], stdout, stderr, syslog[:unix:PATH|:udp:HOST:PORT|:tcp:HOST:PORT], journald[:PATH]")
+	compressMin := flag.Int64("compress-min", 0, "store files of compressible types larger than this many bytes compressed; 0 to disable")
+	compressMime := flag.String("compress-mime", strings.Join(storage.DefaultCompressMime, ","), "comma-separated list of compressible MIME types; entries ending with a slash match prefixes")
+	thumbSize := flag.Int("thumb-size", 0, "maximum width and height of image thumbnails; 0 to disable thumbnails")
+	clamd := flag.String("clamd", "", "address of a clamd daemon to scan uploads with (host:port or Unix socket path)")
+	clamdTimeout := flag.Duration("clamd-timeout", 30*time.Second, "timeout for scanning a file with clamd")
+	clamdFailOpen := flag.Bool("clamd-fail-open", false, "accept uploads if scanning fails instead of rejecting them")
+	encryptKey := flag.String("encrypt-key", "", "path to a file with hex-encoded master keys for encrypting stored files")
+	rekey := flag.Bool("rekey", false, "encrypt all stored files with the first key in -encrypt-key and exit")
+	adminKeyFile := flag.String("admin-key-file", "", "path to a file containing the key for the /admin dashboard; blank to disable it")
+	flag.IntVar(&reportThreshold, "report-threshold", 0, "disable files reported by this many different visitors until the reports are reviewed; 0 to never disable files")
 
 	flag.Parse()
 
 	rand.Seed(time.Now().UnixNano())
 
-	initWebsite()
-
 	uploads = storage.NewStorage("upload")
 	uploads.FilterExt = strings.Split(*filterExt, ",")
 	for i := range uploads.FilterExt {
@@ -105,6 +156,70 @@ func main() {
 	if *idCharset != "" {
 		uploads.IdCharset = *idCharset
 	}
+	uploads.CompressMin = *compressMin
+	uploads.CompressMime = strings.Split(*compressMime, ",")
+	uploads.ThumbSize = *thumbSize
+	if *clamd != "" {
+		uploads.Scanner = storage.NewClamdScanner(*clamd, *clamdTimeout)
+		uploads.ScanFailOpen = *clamdFailOpen
+		uploads.OnScanFailOpen = func(name string, err error) {
+			fmt.Fprintf(os.Stderr, "accepting unscanned file %q: %s\n", name, err)
+		}
+	}
+	if *encryptKey != "" {
+		keys, err := storage.LoadKeyring(*encryptKey)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		uploads.Keys = keys
+	}
+	if *rekey {
+		failed := 0
+		n, err := uploads.Rekey(func(fpath string, err error) {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", fpath, err)
+			failed++
+		})
+		fmt.Printf("re-encrypted %d files\n", n)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if failed > 0 {
+			fmt.Fprintf(os.Stderr, "%d files could not be re-encrypted\n", failed)
+			os.Exit(1)
+		}
+		return
+	}
+	// log entries are hashed with an HMAC key unless a legacy salt is given
+	// without a key; the key is only created if something is hashed
+	keySet := false
+	flag.Visit(func(f *flag.Flag) { keySet = keySet || f.Name == "log-hash-key" })
+	hashing := *enableLog && (*logIPHash || *logUAHash || *logRefererHash)
+	if _, err := os.Stat(*logHashKey); keySet || (*logHashSalt == "" && (hashing || err == nil)) {
+		key, err := LoadHashKey(*logHashKey)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		DefaultLogger.HashKey = key
+		DefaultLogger.HashKeyRotate = *logHashRotate
+	}
+	DefaultLogger.HashSalt = *logHashSalt
+	if flag.NArg() > 0 {
+		logsDir = logSinkDir(*logSinks, "log")
+		os.Exit(runCommand(flag.Args()))
+	}
+
+	if *adminKeyFile != "" {
+		if err := loadAdminKey(*adminKeyFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		initReports()
+	}
+
+	initWebsite()
 
 	if !*enableLog {
 		DefaultLogger = nil
@@ -115,15 +230,71 @@ func main() {
 		DefaultLogger.HashIP = *logIPHash
 		DefaultLogger.HashUserAgent = *logUAHash
 		DefaultLogger.HashReferer = *logRefererHash
-		DefaultLogger.HashSalt = *logHashSalt
 		DefaultLogger.ProxyCount = *proxyCount
+		DefaultLogger.LogDownloads = *logDownloads
+		DefaultLogger.DownloadSampleRate = *logDownloadSample
+		DefaultLogger.Sinks = nil
+		for _, spec := range strings.Split(*logSinks, ",") {
+			sink, err := ParseLogSink(strings.TrimSpace(spec), "log")
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if fs, ok := sink.(*FileSink); ok {
+				fs.RetentionDays = *logRetention
+				fs.Compress = *logCompress
+				fs.MaxFileSize = *logMaxSize
+				fs.StartMaintenance()
+			}
+			DefaultLogger.Sinks = append(DefaultLogger.Sinks, sink)
+		}
 	}
 
+	initHealth()
 	http.HandleFunc("/upload.php", handleUpload)
-	http.Handle("/u/", http.StripPrefix("/u/", http.HandlerFunc(handleFile)))
+	http.HandleFunc("/upload", handleRawUpload)
+	http.HandleFunc("/paste", handlePaste)
+	http.HandleFunc("/a/", handleAlbum)
+	http.HandleFunc("/archive", handleArchive)
+	http.HandleFunc("/api/files/", handleFileInfo)
+	http.HandleFunc(apiPrefix+"/", handleApi)
+	if shortenEnabled {
+		initShorten()
+		startLinkMaintenance()
+	}
+	http.Handle("/u/", http.StripPrefix("/u/", withDownloadLog(handleFile)))
 	if *grill {
 		http.HandleFunc("/grill.php", handleGrill)
 	}
+	if *metrics || *metricsListen != "" {
+		initMetrics()
+		if *metricsListen != "" {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/metrics", handleMetrics)
+			fmt.Printf("serving metrics on http://%s/metrics\n", *metricsListen)
+			go func() {
+				panic(http.ListenAndServe(*metricsListen, mux))
+			}()
+		} else {
+			http.HandleFunc("/metrics", handleMetrics)
+		}
+	}
+	if adminKey != "" {
+		AuditLogger.ProxyCount = *proxyCount
+		if fs := AuditLogger.FileSink(); fs != nil {
+			fs.Dir = path.Join(logSinkDir(*logSinks, "log"), "audit")
+			// the audit log stores admin IP addresses, so it is kept
+			// no longer than the other logs
+			fs.RetentionDays = *logRetention
+			fs.Compress = *logCompress
+			fs.StartMaintenance()
+		}
+		initAdmin()
+		initReportHandlers()
+	}
+	if metricsEnabled || adminKey != "" {
+		startStorageStats()
+	}
 
 	if uploadUrl == "" {
 		if uploadHost != "" {
@@ -142,24 +313,48 @@ func main() {
 		}
 		fmt.Printf("using %q as uploaded file URL\n", uploadUrl)
 	}
+	if albumUrl == "" {
+		if *listenHttps != "" {
+			albumUrl = "https://" + *listenHttps + "/a/"
+		} else if *listenHttp != "" {
+			albumUrl = "http://" + *listenHttp + "/a/"
+		}
+		fmt.Printf("using %q as album URL\n", albumUrl)
+	}
+	if shortenEnabled && shortUrl == "" {
+		if *listenHttps != "" {
+			shortUrl = "https://" + *listenHttps + "/s/"
+		} else if *listenHttp != "" {
+			shortUrl = "http://" + *listenHttp + "/s/"
+		}
+		fmt.Printf("using %q as short link URL\n", shortUrl)
+	}
 
-	exit := true
+	servers := []*http.Server{}
 	if *listenHttp != "" {
-		exit = false
+		srv := &http.Server{Addr: *listenHttp, Handler: http.HandlerFunc(handle)}
+		servers = append(servers, srv)
 		fmt.Printf("listening on http://%s/\n", *listenHttp)
 		go func() {
-			panic(http.ListenAndServe(*listenHttp, http.HandlerFunc(handle)))
+			if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+				panic(err)
+			}
 		}()
 	}
 	if *listenHttps != "" {
-		exit = false
+		srv := &http.Server{Addr: *listenHttps, Handler: http.HandlerFunc(handle)}
+		servers = append(servers, srv)
 		fmt.Printf("listening on https://%s/\n", *listenHttps)
 		go func() {
-			panic(http.ListenAndServeTLS(*listenHttps, *cert, *key, http.HandlerFunc(handle)))
+			if err := srv.ListenAndServeTLS(*cert, *key); err != http.ErrServerClosed {
+				panic(err)
+			}
 		}()
 	}
 
-	if !exit {
-		select {}
+	if len(servers) > 0 {
+		stopFlush := startDownloadFlush()
+		waitForShutdown(servers, *shutdownDelay, *shutdownTimeout)
+		stopFlush()
 	}
 }
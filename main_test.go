@@ -0,0 +1,36 @@
+package main
+
+import (
+	"git.clsr.net/gomf/storage"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// setupTest points the global storage at a temporary folder and disables
+// logging to files
+func setupTest(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gomf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	uploads = storage.NewStorage(path.Join(dir, "upload"))
+	uploadUrl = "http://example.com/u/"
+	DefaultLogger = nil
+	AuditLogger = nil
+	return dir
+}
+
+// loadBuiltinTemplates parses the builtin pages like initWebsite does
+// without a pages/ folder
+func loadBuiltinTemplates(t *testing.T) {
+	templates = template.New("_builtin")
+	for name, text := range builtinPages {
+		if _, err := templates.New(name).Parse(text); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"git.clsr.net/gomf/storage"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics are exposed in the Prometheus text format
+
+const storageStatsInterval = time.Minute
+
+var (
+	metricsEnabled bool
+
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+	mimeBuckets    = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+	metricsLock       sync.Mutex
+	uploadsTotal      = newCounterVec("gomf_uploads_total", "Uploaded files by outcome.", "outcome")
+	uploadBytes       = newCounterVec("gomf_upload_bytes_total", "Bytes of successfully uploaded files.", "")
+	dedupHits         = newCounterVec("gomf_upload_dedup_hits_total", "Uploads of files that were already stored.", "")
+	downloadsTotal    = newCounterVec("gomf_downloads_total", "Requests for uploaded files by status code.", "status")
+	downloadBytes     = newCounterVec("gomf_download_bytes_total", "Bytes of uploaded files served.", "")
+	requestDuration   = newHistogramVec("gomf_http_request_duration_seconds", "HTTP request latency by route.", "route", latencyBuckets)
+	mimeDetectionTime = newHistogramVec("gomf_mime_detection_seconds", "Time taken by libmagic to detect the MIME type of uploads.", "", mimeBuckets)
+
+	storageStatsLock sync.Mutex
+	storageStats     storage.Stats
+	storageStatsTime time.Time
+)
+
+type counterVec struct {
+	name, help, label string
+	values            map[string]float64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, values: make(map[string]float64)}
+}
+
+func (c *counterVec) add(label string, v float64) {
+	metricsLock.Lock()
+	c.values[label] += v
+	metricsLock.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if c.label == "" {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.values[""]))
+		return
+	}
+	for _, l := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s=%q} %s\n", c.name, c.label, l, formatFloat(c.values[l]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name, help, label string
+	buckets           []float64
+	series            map[string]*histogram
+}
+
+func newHistogramVec(name, help, label string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(label string, v float64) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	s := h.series[label]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[label] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	labels := make([]string, 0, len(h.series))
+	for l := range h.series {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		s := h.series[l]
+		prefix := ""
+		if h.label != "" {
+			prefix = fmt.Sprintf("%s=%q,", h.label, l)
+		}
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", h.name, prefix, formatFloat(b), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", h.name, prefix, s.count)
+		labelSet := ""
+		if prefix != "" {
+			labelSet = "{" + strings.TrimSuffix(prefix, ",") + "}"
+		}
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labelSet, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelSet, s.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func initMetrics() {
+	metricsEnabled = true
+	uploads.OnMimeDetect = func(d time.Duration) { mimeDetectionTime.observe("", d.Seconds()) }
+	uploads.OnDedup = func() { dedupHits.add("", 1) }
+}
+
+// uploadOutcome returns the label of an upload result for metrics
+func uploadOutcome(err error) string {
+	switch err.(type) {
+	case nil:
+		return "success"
+	case storage.ErrTooLarge:
+		return "too_large"
+	case storage.ErrForbidden:
+		return "forbidden"
+	case storage.ErrBlocked:
+		return "blocked"
+	case storage.ErrInfected:
+		return "infected"
+	case storage.ErrScanFailed:
+		return "scan_failed"
+	}
+	return "error"
+}
+
+func observeUpload(err error, size int64) {
+	if !metricsEnabled {
+		return
+	}
+	uploadsTotal.add(uploadOutcome(err), 1)
+	if err == nil {
+		uploadBytes.add("", float64(size))
+	}
+}
+
+func observeDownload(status int, bytes int64) {
+	downloadsTotal.add(strconv.Itoa(status), 1)
+	downloadBytes.add("", float64(bytes))
+}
+
+// routeOf returns the handler pattern a request is routed to
+func routeOf(r *http.Request) string {
+	_, pattern := http.DefaultServeMux.Handler(r)
+	if pattern == "" {
+		return "none"
+	}
+	return pattern
+}
+
+// startStorageStats computes storage statistics in the background every
+// storageStatsInterval, since computing them walks all uploads
+func startStorageStats() {
+	go func() {
+		ticker := time.NewTicker(storageStatsInterval)
+		defer ticker.Stop()
+		for {
+			if stats, err := uploads.Stats(); err == nil {
+				storageStatsLock.Lock()
+				storageStats, storageStatsTime = stats, time.Now()
+				storageStatsLock.Unlock()
+			} else {
+				fmt.Fprintln(os.Stderr, "error computing storage stats:", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// currentStorageStats returns the last storage statistics computed by
+// startStorageStats and when they were computed, without waiting for them
+func currentStorageStats() (storage.Stats, time.Time) {
+	storageStatsLock.Lock()
+	defer storageStatsLock.Unlock()
+	return storageStats, storageStatsTime
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	stats, statsTime := currentStorageStats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metricsLock.Lock()
+	uploadsTotal.write(w)
+	uploadBytes.write(w)
+	dedupHits.write(w)
+	downloadsTotal.write(w)
+	downloadBytes.write(w)
+	requestDuration.write(w)
+	mimeDetectionTime.write(w)
+	metricsLock.Unlock()
+
+	gauge := func(name, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, v)
+	}
+	if statsTime.IsZero() {
+		return // not computed yet
+	}
+	gauge("gomf_storage_blobs", "Stored files.", int64(stats.Blobs))
+	gauge("gomf_storage_ids", "File IDs.", int64(stats.Ids))
+	gauge("gomf_storage_bytes", "Size of stored files.", stats.Bytes)
+	gauge("gomf_storage_disk_bytes", "Disk space used by stored files.", stats.DiskBytes)
+	gauge("gomf_storage_stats_timestamp_seconds", "Time the storage gauges were computed.", statsTime.Unix())
+}
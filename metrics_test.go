@@ -0,0 +1,33 @@
+package main
+
+import (
+	"git.clsr.net/gomf/storage"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsStorageStats(t *testing.T) {
+	setupTest(t)
+	defer func() { storageStats, storageStatsTime = storage.Stats{}, time.Time{} }()
+
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	if body := scrape(); strings.Contains(body, "gomf_storage_") || !strings.Contains(body, "gomf_uploads_total") {
+		t.Errorf("metrics before computing storage stats:\n%s", body)
+	}
+
+	storageStatsLock.Lock()
+	storageStats, storageStatsTime = storage.Stats{Blobs: 3, Ids: 5}, time.Unix(1600000000, 0)
+	storageStatsLock.Unlock()
+	body := scrape()
+	for _, line := range []string{"gomf_storage_blobs 3", "gomf_storage_ids 5", "gomf_storage_stats_timestamp_seconds 1600000000"} {
+		if !strings.Contains(body, "\n"+line+"\n") {
+			t.Errorf("metrics do not contain %q:\n%s", line, body)
+		}
+	}
+}
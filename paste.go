@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"git.clsr.net/gomf/storage"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// maxViewSize is the largest file that is highlighted by /ID/view
+const maxViewSize = 1 << 20
+
+func init() {
+	builtinPages["paste.html"] = pastePage
+	builtinPages["_view.html"] = viewPage
+}
+
+type viewContext struct {
+	pageContext
+	Name     string
+	Url      string
+	Language string
+	Lines    []template.HTML
+	TooLarge bool
+}
+
+// pasteExt returns the extension for a pasted text in the given language,
+// which is a file extension without the dot
+func pasteExt(lang string) string {
+	lang = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(lang), "."))
+	if lang == "" || len(lang) > 10 || strings.IndexFunc(lang, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '+')
+	}) >= 0 {
+		return ".txt"
+	}
+	return "." + lang
+}
+
+// handlePaste stores text from the paste form field or the raw request body,
+// named after the lang parameter; output=redirect redirects to its view page
+func handlePaste(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "The method is not allowed for the requested URL.", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	output := query.Get("output")
+	resp := response{Files: []result{}}
+	opts := storage.Options{}
+
+	var rd io.Reader = r.Body
+	form := url.Values{}
+	ctype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch ctype {
+	case "multipart/form-data":
+		r.ParseMultipartForm(maxViewSize)
+		form = r.Form
+		if _, ok := form["paste"]; !ok {
+			resp.ErrorCode = http.StatusBadRequest
+			resp.Description = "missing paste field"
+			respond(w, output, resp)
+			return
+		}
+	case "application/x-www-form-urlencoded":
+		// curl --data-binary sends raw bodies as forms, so this is only a
+		// form if it has a paste field
+		limit := uploads.MaxSize
+		if limit <= 0 {
+			limit = 1 << 62
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+		if err != nil {
+			resp.ErrorCode = http.StatusBadRequest
+			resp.Description = err.Error()
+			respond(w, output, resp)
+			return
+		}
+		if vals, err := url.ParseQuery(string(data)); err == nil && len(vals["paste"]) > 0 {
+			form = vals
+		} else {
+			rd = bytes.NewReader(data)
+		}
+	}
+	lang := query.Get("lang")
+	if _, ok := form["paste"]; ok {
+		if v := form.Get("output"); output == "" {
+			output = v
+		}
+		if v := form.Get("lang"); v != "" {
+			lang = v
+		}
+		rd = strings.NewReader(form.Get("paste"))
+	} else if output == "" {
+		output = "text"
+	}
+	if output == "redirect" {
+		if store(r, &resp, rd, "paste"+pasteExt(lang), opts) {
+			http.Redirect(w, r, resp.Files[0].Url+"/view", http.StatusSeeOther)
+			return
+		}
+		output = "html"
+	} else {
+		store(r, &resp, rd, "paste"+pasteExt(lang), opts)
+	}
+	respond(w, output, resp)
+}
+
+// isText reports whether a MIME type can be shown as text
+func isText(mtype string) bool {
+	mtype, _, _ = mime.ParseMediaType(mtype)
+	if strings.HasPrefix(mtype, "text/") {
+		return true
+	}
+	switch mtype {
+	case "application/json", "application/javascript", "application/x-javascript", "application/xml",
+		"application/x-sh", "application/x-shellscript", "application/toml", "application/yaml",
+		"application/x-yaml", "application/sql", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+func handleView(w http.ResponseWriter, r *http.Request, id string) {
+	meta, err := uploads.GetMeta(id)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	f, _, size, _, err := uploads.Get(id)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	defer f.Close()
+
+	ext := strings.ToLower(path.Ext(f.Name()))
+	mtype := meta.Mime
+	if mtype == "" {
+		mtype = mime.TypeByExtension(ext)
+	}
+	if meta.Encrypted || !isText(mtype) {
+		http.NotFound(w, r)
+		return
+	}
+
+	context := viewContext{
+		pageContext: newContext(),
+		Name:        path.Base(f.Name()),
+		Url:         strings.TrimRight(uploadUrl, "/") + "/" + id,
+		TooLarge:    size > maxViewSize,
+	}
+	if !context.TooLarge {
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		lang := languages[ext]
+		if lang != nil {
+			context.Language = lang.name
+		}
+		context.Lines = highlight(lang, string(data))
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'none'; frame-ancestors 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := templates.ExecuteTemplate(w, "_view.html", context); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+const pastePage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.SiteName}} &middot; Paste</title>
+</head>
+<body>
+<h1>{{.SiteName}}</h1>
+<p>Max paste size is {{.MaxSize}}.</p>
+<form method="post" action="/paste" enctype="multipart/form-data">
+<input type="hidden" name="output" value="redirect">
+<p><textarea name="paste" rows="25" cols="100" required></textarea></p>
+<p>
+<select name="lang">
+<option value="txt">Plain text</option>
+<option value="c">C</option>
+<option value="cpp">C++</option>
+<option value="css">CSS</option>
+<option value="go">Go</option>
+<option value="hs">Haskell</option>
+<option value="html">HTML</option>
+<option value="ini">INI</option>
+<option value="java">Java</option>
+<option value="js">JavaScript</option>
+<option value="json">JSON</option>
+<option value="lua">Lua</option>
+<option value="php">PHP</option>
+<option value="py">Python</option>
+<option value="rb">Ruby</option>
+<option value="rs">Rust</option>
+<option value="sh">Shell</option>
+<option value="sql">SQL</option>
+<option value="ts">TypeScript</option>
+<option value="xml">XML</option>
+<option value="yaml">YAML</option>
+</select>
+<input type="submit" value="Paste">
+</p>
+</form>
+</body>
+</html>
+`
+
+const viewPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}} &middot; {{.SiteName}}</title>
+<style>
+body { margin: 1em 2em; font-family: sans-serif; }
+pre { counter-reset: line; line-height: 1.4; background: #f8f8f8; padding: 0.5em 0; overflow-x: auto; }
+pre span.l { display: block; min-height: 1.4em; counter-increment: line; padding-right: 1em; }
+pre span.l::before { content: counter(line); display: inline-block; width: 4em; margin-right: 1em; padding-right: 0.5em; text-align: right; color: #999; border-right: 1px solid #ddd; user-select: none; }
+.k { color: #a626a4; font-weight: bold; }
+.s { color: #50a14f; }
+.c { color: #a0a1a7; font-style: italic; }
+.n { color: #986801; }
+</style>
+</head>
+<body>
+<p><b>{{.Name}}</b>{{if .Language}} &middot; {{.Language}}{{end}} &middot; <a href="{{.Url}}">raw</a></p>
+{{if .TooLarge}}
+<p>This file is too large to view here.</p>
+{{else}}
+<pre>{{range .Lines}}<span class="l">{{.}}</span>{{end}}</pre>
+{{end}}
+</body>
+</html>
+`
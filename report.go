@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"git.clsr.net/gomf/storage"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const maxReportReason = 2000
+
+// reportThreshold is the number of distinct reporters after which a file is
+// disabled until the reports are reviewed; 0 never disables files
+var reportThreshold int
+
+type reportContext struct {
+	pageContext
+	Url     string
+	Reason  string
+	Message string
+	Error   bool
+}
+
+func initReports() {
+	builtinPages["report.html"] = reportPage
+	builtinPages["_admin-reports.html"] = adminReportsPage
+}
+
+func initReportHandlers() {
+	http.HandleFunc("/report", handleReport)
+	http.HandleFunc("/admin/reports", adminAuth(handleAdminReports))
+	http.HandleFunc("/admin/dismiss", adminAuth(adminAction("dismiss", func(id string) error {
+		return uploads.DismissReports(id)
+	})))
+}
+
+// reportedId extracts the ID of an upload from its URL
+func reportedId(str string) string {
+	if u, err := url.Parse(strings.TrimSpace(str)); err == nil {
+		str = u.Path
+	}
+	parts := strings.Split(strings.Trim(str, "/"), "/")
+	id := parts[len(parts)-1]
+	if (id == "thumb" || id == "decrypt" || id == "view") && len(parts) > 1 {
+		id = parts[len(parts)-2]
+	}
+	return id
+}
+
+// reporterId identifies the reporter without storing their IP address
+func reporterId(r *http.Request) string {
+	mac := hmac.New(sha256.New, []byte(adminKey))
+	mac.Write([]byte(AuditLogger.clientIP(r)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:12])
+}
+
+func handleReport(w http.ResponseWriter, r *http.Request) {
+	context := reportContext{pageContext: newContext(), Url: r.FormValue("url")}
+	if r.Method == http.MethodPost {
+		context.Reason = strings.TrimSpace(r.PostFormValue("reason"))
+		id := reportedId(context.Url)
+		if id == "" || context.Reason == "" {
+			context.Message, context.Error = "Please enter the URL of the file and the reason for reporting it.", true
+		} else if len(context.Reason) > maxReportReason {
+			context.Message, context.Error = fmt.Sprintf("The reason must be at most %d characters long.", maxReportReason), true
+		} else {
+			reporters, err := uploads.AddReport(id, storage.Report{
+				Url:      context.Url,
+				Reason:   context.Reason,
+				Reporter: reporterId(r),
+				Time:     time.Now().UTC(),
+			})
+			if _, ok := err.(storage.ErrNotFound); ok {
+				context.Message, context.Error = "The file "+id+" does not exist.", true
+			} else if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				context.Message, context.Error = "The report could not be saved; please try again later.", true
+			} else {
+				if reportThreshold > 0 && reporters >= reportThreshold {
+					if err = uploads.SetDisabled(id, true); err != nil {
+						fmt.Fprintln(os.Stderr, err)
+					}
+				}
+				context.Message, context.Url, context.Reason = "Thank you, the file will be reviewed.", "", ""
+			}
+		}
+		if context.Error {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}
+	if err := templates.ExecuteTemplate(w, "report.html", context); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+func handleAdminReports(w http.ResponseWriter, r *http.Request) {
+	context := struct {
+		adminContext
+		Reports []storage.ReportedFile
+	}{adminContext: newAdminContext(w, r)}
+	var err error
+	if context.Reports, err = uploads.Reports(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := templates.ExecuteTemplate(w, "_admin-reports.html", context); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+const reportPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.SiteName}} &middot; Report a file</title>
+</head>
+<body>
+<h1>{{.SiteName}}</h1>
+<p>Use this form to report files that are illegal or abusive. For other matters, contact <a href="mailto:{{.Abuse}}">{{.Abuse}}</a>.</p>
+{{if .Message}}<p><b>{{.Message}}</b></p>{{end}}
+<form method="post" action="/report">
+<p><label>File URL<br><input type="url" name="url" value="{{.Url}}" size="60" required></label></p>
+<p><label>Reason<br><textarea name="reason" rows="6" cols="60" maxlength="2000" required>{{.Reason}}</textarea></label></p>
+<p><input type="submit" value="Report"></p>
+</form>
+</body>
+</html>
+`
+
+const adminReportsPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.SiteName}} &middot; Admin reports</title>
+` + adminStyle + `
+</head>
+<body>
+` + adminNav + `
+<table>
+<tr><th>ID</th><th>Reports</th><th></th></tr>
+{{range .Reports}}
+<tr>
+<td><a href="/admin?q={{.Id}}">{{.Id}}</a>{{if .Disabled}}<br>(disabled){{end}}</td>
+<td>{{range .Reports}}{{.Time.Format "2006-01-02 15:04:05"}} <i>{{.Reporter}}</i>: {{.Url}}<br>{{.Reason}}<br>{{end}}</td>
+<td>
+<form class="inline" method="post" action="/admin/delete"><input type="hidden" name="token" value="{{$.Token}}"><input type="hidden" name="return" value="/admin/reports"><input type="hidden" name="id" value="{{.Id}}"><input type="submit" value="Take down"></form>
+<form class="inline" method="post" action="/admin/block"><input type="hidden" name="token" value="{{$.Token}}"><input type="hidden" name="return" value="/admin/reports"><input type="hidden" name="id" value="{{.Id}}"><input type="submit" value="Take down and ban hash"></form>
+<form class="inline" method="post" action="/admin/dismiss"><input type="hidden" name="token" value="{{$.Token}}"><input type="hidden" name="return" value="/admin/reports"><input type="hidden" name="id" value="{{.Id}}"><input type="submit" value="Dismiss"></form>
+</td>
+</tr>
+{{else}}
+<tr><td colspan="3">No pending reports.</td></tr>
+{{end}}
+</table>
+</body>
+</html>
+`
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// maxLinkUrl is the longest URL that can be shortened
+	maxLinkUrl = 4096
+	// linkMaintenanceInterval is how often expired short links are removed
+	linkMaintenanceInterval = time.Hour
+)
+
+var (
+	shortenEnabled bool
+	shortUrl       string
+)
+
+func initShorten() {
+	http.HandleFunc("/shorten", handleShorten)
+	http.HandleFunc("/s/", handleLink)
+}
+
+// startLinkMaintenance removes expired short links in the background every
+// linkMaintenanceInterval
+func startLinkMaintenance() {
+	go func() {
+		ticker := time.NewTicker(linkMaintenanceInterval)
+		defer ticker.Stop()
+		for {
+			if _, err := uploads.RemoveExpiredLinks(); err != nil {
+				fmt.Fprintln(os.Stderr, "error removing expired links:", err)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// validLinkUrl reports whether rawurl is an absolute HTTP(S) URL
+func validLinkUrl(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && len(rawurl) <= maxLinkUrl
+}
+
+func handleShorten(w http.ResponseWriter, r *http.Request) {
+	output := r.FormValue("output")
+	resp := response{Files: []result{}}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		resp.ErrorCode = http.StatusMethodNotAllowed
+		resp.Description = "The method is not allowed for the requested URL."
+		respond(w, output, resp)
+		return
+	}
+
+	target := strings.TrimSpace(r.FormValue("url"))
+	var expires time.Time
+	if v := r.FormValue("expires"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			resp.ErrorCode = http.StatusBadRequest
+			resp.Description = "invalid expiry duration: " + v
+			respond(w, output, resp)
+			return
+		}
+		expires = time.Now().Add(d)
+	}
+	if !validLinkUrl(target) {
+		resp.ErrorCode = http.StatusBadRequest
+		resp.Description = "invalid URL; only http and https URLs can be shortened"
+		respond(w, output, resp)
+		return
+	}
+
+	id, err := uploads.NewLink(target, expires)
+	if err != nil {
+		resp.ErrorCode = http.StatusInternalServerError
+		resp.Description = err.Error()
+		respond(w, output, resp)
+		return
+	}
+	res := result{
+		Url:  strings.TrimRight(shortUrl, "/") + "/" + id,
+		Name: target,
+	}
+	if !expires.IsZero() {
+		res.Expires = expires.UTC().Format(time.RFC3339)
+	}
+	LogLink(r, id, target)
+	resp.Files = append(resp.Files, res)
+	respond(w, output, resp)
+}
+
+func handleLink(w http.ResponseWriter, r *http.Request) {
+	link, err := uploads.GetLink(strings.TrimPrefix(r.URL.Path, "/s/"))
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	http.Redirect(w, r, link.Url, http.StatusFound)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidLinkUrl(t *testing.T) {
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://example.org/path?q=1", true},
+		{"http://example.org", true},
+		{"ftp://example.org/file", false},
+		{"javascript:alert(1)", false},
+		{"//example.org/path", false},
+		{"https://", false},
+		{"not a url", false},
+		{"https://example.org/" + strings.Repeat("a", maxLinkUrl), false},
+	}
+	for _, test := range tests {
+		if valid := validLinkUrl(test.url); valid != test.valid {
+			t.Errorf("validLinkUrl(%q) = %v, want %v", test.url, valid, test.valid)
+		}
+	}
+}
+
+func TestShorten(t *testing.T) {
+	setupTest(t)
+	shortUrl = "https://s.example.com/s/"
+	shorten := func(method string, form url.Values) (*httptest.ResponseRecorder, response) {
+		r := httptest.NewRequest(method, "/shorten", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handleShorten(w, r)
+		var resp response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid response %q: %s", w.Body, err)
+		}
+		return w, resp
+	}
+	follow := func(id string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleLink(w, httptest.NewRequest("GET", "/s/"+id, nil))
+		return w
+	}
+
+	target := "https://example.org/some/long/path"
+	w, resp := shorten("POST", url.Values{"url": {target}})
+	if w.Code != http.StatusOK || !resp.Success || len(resp.Files) != 1 || resp.Files[0].Name != target || resp.Files[0].Expires != "" {
+		t.Fatalf("shorten: status %d, %+v", w.Code, resp)
+	}
+	id := strings.TrimPrefix(resp.Files[0].Url, shortUrl)
+	if w = follow(id); w.Code != http.StatusFound || w.Header().Get("Location") != target || w.Header().Get("Referrer-Policy") != "no-referrer" {
+		t.Errorf("following %s: status %d, headers %v", id, w.Code, w.Header())
+	}
+
+	w, resp = shorten("POST", url.Values{"url": {target}, "expires": {"1h"}})
+	expires, err := time.Parse(time.RFC3339, resp.Files[0].Expires)
+	if w.Code != http.StatusOK || err != nil || expires.Before(time.Now().Add(59*time.Minute)) || expires.After(time.Now().Add(time.Hour)) {
+		t.Errorf("expiring link: status %d, expires %q", w.Code, resp.Files[0].Expires)
+	}
+
+	errorTests := []struct {
+		method string
+		form   url.Values
+		status int
+	}{
+		{"GET", url.Values{"url": {target}}, http.StatusMethodNotAllowed},
+		{"POST", url.Values{}, http.StatusBadRequest},
+		{"POST", url.Values{"url": {"file:///etc/passwd"}}, http.StatusBadRequest},
+		{"POST", url.Values{"url": {target}, "expires": {"soon"}}, http.StatusBadRequest},
+		{"POST", url.Values{"url": {target}, "expires": {"-1h"}}, http.StatusBadRequest},
+	}
+	for _, test := range errorTests {
+		if w, resp = shorten(test.method, test.form); w.Code != test.status || resp.Success {
+			t.Errorf("%s %v: status %d, want %d", test.method, test.form, w.Code, test.status)
+		}
+	}
+	if w = follow("zzzzzz"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown link: status %d", w.Code)
+	}
+}
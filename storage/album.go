@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// albums are stored as albums/<ii>/<ii>/<id>/album.json and only refer to
+// uploaded files by ID, so removing a file does not change its albums
+
+type Album struct {
+	Ids     []string  `json:"ids"`
+	Created time.Time `json:"created"`
+}
+
+// NewAlbum stores an album of uploaded files under a new ID
+func (s *Storage) NewAlbum(ids []string) (id string, err error) {
+	data, err := json.Marshal(Album{Ids: ids, Created: time.Now().UTC()})
+	if err != nil {
+		return
+	}
+	id, dir, err := s.allocId("albums")
+	if err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(path.Join(dir, "album.json"), data, 0644); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return id, nil
+}
+
+// GetAlbum returns the album with the given ID
+func (s *Storage) GetAlbum(id string) (album Album, err error) {
+	dir, err := s.namespaceFolder("albums", id)
+	if err != nil {
+		return
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, "album.json"))
+	if os.IsNotExist(err) {
+		return album, ErrNotFound{id}
+	} else if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &album)
+	return
+}
+
+// RemoveAlbum removes an album but not the files in it
+func (s *Storage) RemoveAlbum(id string) error {
+	dir, err := s.namespaceFolder("albums", id)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(dir); os.IsNotExist(err) {
+		return ErrNotFound{id}
+	}
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the blocklist is a text file in the storage folder with one hex-encoded
+// SHA-1 hash per line; it is reloaded whenever its size or modification time
+// changes, which is checked at most every blocklistCheckInterval
+const (
+	blocklistName          = "blocklist"
+	blocklistCheckInterval = time.Second
+)
+
+type ErrBlocked struct{ Hash string }
+
+func (e ErrBlocked) Error() string { return "file " + e.Hash + " is unavailable for legal reasons" }
+
+type blocklist struct {
+	lock    sync.Mutex
+	checked time.Time
+	modtime time.Time
+	size    int64
+	hashes  map[string]bool
+}
+
+func (s *Storage) blocklistPath() string {
+	return path.Join(s.Folder, blocklistName)
+}
+
+// Blocked reports whether the hex-encoded hash is on the blocklist
+func (s *Storage) Blocked(hash string) (bool, error) {
+	bl := &s.blocklist
+	bl.lock.Lock()
+	defer bl.lock.Unlock()
+	if bl.hashes != nil && time.Since(bl.checked) < blocklistCheckInterval {
+		return bl.hashes[strings.ToLower(hash)], nil
+	}
+
+	stat, err := os.Stat(s.blocklistPath())
+	if os.IsNotExist(err) {
+		bl.hashes = make(map[string]bool)
+		bl.checked, bl.modtime, bl.size = time.Now(), time.Time{}, -1
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if bl.hashes == nil || !stat.ModTime().Equal(bl.modtime) || stat.Size() != bl.size {
+		f, err := os.Open(s.blocklistPath())
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		hashes := make(map[string]bool)
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			if line := strings.TrimSpace(sc.Text()); line != "" && line[0] != '#' {
+				hashes[strings.ToLower(line)] = true
+			}
+		}
+		if err = sc.Err(); err != nil {
+			return false, err
+		}
+		bl.hashes = hashes
+		bl.modtime = stat.ModTime()
+		bl.size = stat.Size()
+	}
+	bl.checked = time.Now()
+	return bl.hashes[strings.ToLower(hash)], nil
+}
+
+// Block adds the hash of the file with the given ID to the blocklist and
+// removes it along with all IDs referring to it; it returns the removed IDs
+//
+// the links of removed IDs are kept so the IDs are not reused and requests
+// for them can be told apart from requests for IDs that never existed
+func (s *Storage) Block(idext string) (ids []string, err error) {
+	_, blob, err := s.lookup(idext)
+	if err != nil {
+		return
+	}
+	bhash := path.Base(path.Dir(blob))
+	hash, err := base64ToHex(bhash)
+	if err != nil {
+		return
+	}
+
+	s.blocklist.lock.Lock()
+	f, err := os.OpenFile(s.blocklistPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err == nil {
+		_, err = f.WriteString(hash + "\n")
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	// the cache is updated directly, since the file may not look changed
+	// if it is written within the same modification time tick
+	if err == nil && s.blocklist.hashes != nil {
+		s.blocklist.hashes[hash] = true
+	}
+	s.blocklist.lock.Unlock()
+	if err != nil {
+		return
+	}
+
+	ids, err = s.idsByHash(bhash)
+	if err != nil {
+		return
+	}
+	for _, id := range ids {
+		if err = s.setMeta(id[:len(id)-len(path.Ext(id))], Meta{}); err != nil {
+			return
+		}
+		s.dropDownloads(id[:len(id)-len(path.Ext(id))])
+		if err = s.removeReports(id[:len(id)-len(path.Ext(id))]); err != nil {
+			return
+		}
+	}
+	err = os.RemoveAll(s.idToFolder("files", bhash))
+	return
+}
+
+// idsByHash returns the IDs (with extensions) of all links to the stored file
+// with the given base64-encoded hash
+func (s *Storage) idsByHash(bhash string) (ids []string, err error) {
+	err = filepath.Walk(path.Join(s.Folder, "ids"), func(fpath string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return err
+		}
+		target, err := os.Readlink(fpath)
+		if err != nil {
+			return err
+		}
+		if path.Base(path.Dir(target)) == bhash {
+			ids = append(ids, path.Base(path.Dir(fpath))+path.Ext(fpath))
+		}
+		return nil
+	})
+	return
+}
+
+func base64ToHex(bhash string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(bhash)
+	return hex.EncodeToString(b), err
+}
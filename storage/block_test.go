@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlockReupload(t *testing.T) {
+	s, _ := newTestStorage(t)
+	content := "blocked content"
+	id, _, _, _, err := s.New(strings.NewReader(content), "a.txt", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// load the cache before blocking, so it has to be updated by Block
+	if blocked, err := s.Blocked("0000000000000000000000000000000000000000"); err != nil || blocked {
+		t.Fatalf("Blocked = %v, %v", blocked, err)
+	}
+	ids, err := s.Block(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] != id {
+		t.Errorf("Block returned %q, want %q", ids, id)
+	}
+
+	if _, _, _, _, err = s.New(strings.NewReader(content), "b.txt", Options{}); !isBlocked(err) {
+		t.Errorf("re-upload: got %v, want ErrBlocked", err)
+	}
+	if _, _, _, _, err = s.Get(id); !isBlocked(err) {
+		t.Errorf("Get: got %v, want ErrBlocked", err)
+	}
+	if _, _, _, _, err = s.New(strings.NewReader("other content"), "c.txt", Options{}); err != nil {
+		t.Errorf("other upload: %s", err)
+	}
+}
+
+func TestBlocklistReload(t *testing.T) {
+	s, _ := newTestStorage(t)
+	if blocked, err := s.Blocked("00"); err != nil || blocked {
+		t.Fatalf("Blocked = %v, %v", blocked, err)
+	}
+
+	sum := sha1.Sum([]byte("edited by hand"))
+	hash := hex.EncodeToString(sum[:])
+	write := func(data string) {
+		if err := ioutil.WriteFile(s.blocklistPath(), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// an edit in the same modification time tick
+		if err := os.Chtimes(s.blocklistPath(), time.Unix(1e9, 0), time.Unix(1e9, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# comment\n")
+	s.blocklist.checked = time.Time{}
+	if blocked, _ := s.Blocked(hash); blocked {
+		t.Fatal("blocked before it was added")
+	}
+	write("# comment\n" + strings.ToUpper(hash) + "\n")
+	if blocked, _ := s.Blocked(hash); blocked {
+		t.Error("blocklist was reloaded before blocklistCheckInterval")
+	}
+	s.blocklist.checked = time.Time{}
+	if blocked, _ := s.Blocked(hash); !blocked {
+		t.Error("blocklist with a different size was not reloaded")
+	}
+}
+
+func isBlocked(err error) bool {
+	_, ok := err.(ErrBlocked)
+	return ok
+}
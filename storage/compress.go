@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// compressed blobs are a single gzip member whose deflate stream consists of
+// independently compressed, byte-aligned segments ("frames") of gzFrameSize
+// plaintext bytes each; the gzindex file next to the blob records where each
+// frame starts so the plaintext can be read from any offset
+const (
+	gzFrameSize = 1024 * 1024
+	gzIndexName = "gzindex"
+)
+
+var DefaultCompressMime = []string{
+	"text/",
+	"application/json",
+	"application/xml",
+	"application/javascript",
+	"application/x-ndjson",
+	"image/svg+xml",
+	"image/bmp",
+}
+
+type gzIndex struct {
+	frameSize int64
+	size      int64
+	offsets   []int64 // start of each frame and the end of the last one
+}
+
+func (idx *gzIndex) MarshalBinary() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, idx.frameSize)
+	binary.Write(buf, binary.BigEndian, idx.size)
+	binary.Write(buf, binary.BigEndian, idx.offsets)
+	return buf.Bytes(), nil
+}
+
+func (idx *gzIndex) UnmarshalBinary(data []byte) error {
+	if len(data) < 24 || len(data)%8 != 0 {
+		return errors.New("invalid compression index")
+	}
+	idx.frameSize = int64(binary.BigEndian.Uint64(data[0:]))
+	idx.size = int64(binary.BigEndian.Uint64(data[8:]))
+	idx.offsets = make([]int64, (len(data)-16)/8)
+	for i := range idx.offsets {
+		idx.offsets[i] = int64(binary.BigEndian.Uint64(data[16+i*8:]))
+	}
+	if idx.frameSize <= 0 || int64(len(idx.offsets)-1) != (idx.size+idx.frameSize-1)/idx.frameSize {
+		return errors.New("invalid compression index")
+	}
+	return nil
+}
+
+func readGzIndex(fpath string) (*gzIndex, error) {
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+	idx := &gzIndex{}
+	return idx, idx.UnmarshalBinary(data)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.w.Write(p)
+	cw.n += int64(n)
+	return
+}
+
+var gzHeader = []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 2, 255}
+
+func writeGzFrames(w io.Writer, r io.Reader) (*gzIndex, error) {
+	cw := &countWriter{w: w}
+	if _, err := cw.Write(gzHeader); err != nil {
+		return nil, err
+	}
+	idx := &gzIndex{frameSize: gzFrameSize, offsets: []int64{cw.n}}
+	crc := crc32.NewIEEE()
+	r = io.TeeReader(r, crc)
+	fw, _ := flate.NewWriter(cw, flate.BestCompression)
+	for {
+		// a fresh compressor does not refer back to previous frames and
+		// Flush ends the frame on a byte boundary without a final block
+		fw.Reset(cw)
+		n, err := io.CopyN(fw, r, gzFrameSize)
+		if n == 0 && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if err := fw.Flush(); err != nil {
+			return nil, err
+		}
+		idx.size += n
+		idx.offsets = append(idx.offsets, cw.n)
+		if err == io.EOF {
+			break
+		}
+	}
+	fw.Reset(cw)
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+	trailer := make([]byte, 8)
+	binary.LittleEndian.PutUint32(trailer[0:], crc.Sum32())
+	binary.LittleEndian.PutUint32(trailer[4:], uint32(idx.size))
+	_, err := cw.Write(trailer)
+	return idx, err
+}
+
+func (s *Storage) compressible(mimetype string, size int64) bool {
+	if s.CompressMin <= 0 || size < s.CompressMin {
+		return false
+	}
+	for _, m := range s.CompressMime {
+		if m == mimetype || (strings.HasSuffix(m, "/") && strings.HasPrefix(mimetype, m)) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressBlob stores a compressed copy of file in hfolder; it returns false
+// if compression did not save enough space to be worth it
+func (s *Storage) compressBlob(file *os.File, hfolder string, size int64) (bool, error) {
+	temp, err := ioutil.TempFile(path.Join(s.Folder, "temp"), "gzip")
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		temp.Close()
+		os.Remove(temp.Name())
+	}()
+
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	idx, err := writeGzFrames(temp, file)
+	if err != nil {
+		return false, err
+	}
+	if idx.offsets[len(idx.offsets)-1] > size*9/10 {
+		return false, nil
+	}
+
+	data, _ := idx.MarshalBinary()
+	if err = ioutil.WriteFile(path.Join(hfolder, gzIndexName), data, 0644); err != nil {
+		return false, err
+	}
+	if _, err = temp.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	return true, s.writeBlob(path.Join(hfolder, "file"), temp)
+}
+
+type gzReader struct {
+	r     io.ReadSeeker
+	idx   *gzIndex
+	off   int64
+	frame int
+	buf   []byte
+}
+
+func newGzReader(r io.ReadSeeker, idx *gzIndex) *gzReader {
+	return &gzReader{r: r, idx: idx, frame: -1}
+}
+
+func (r *gzReader) Read(p []byte) (n int, err error) {
+	if r.off >= r.idx.size {
+		return 0, io.EOF
+	}
+	i := int(r.off / r.idx.frameSize)
+	if i != r.frame {
+		if err = r.load(i); err != nil {
+			return
+		}
+	}
+	n = copy(p, r.buf[r.off-int64(i)*r.idx.frameSize:])
+	r.off += int64(n)
+	return
+}
+
+func (r *gzReader) load(i int) error {
+	start, end := r.idx.offsets[i], r.idx.offsets[i+1]
+	if _, err := r.r.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	zr := flate.NewReader(io.LimitReader(r.r, end-start))
+	defer zr.Close()
+	n := r.idx.frameSize
+	if rest := r.idx.size - int64(i)*n; rest < n {
+		n = rest
+	}
+	if int64(cap(r.buf)) < n {
+		r.buf = make([]byte, n)
+	}
+	r.buf = r.buf[:n]
+	if _, err := io.ReadFull(zr, r.buf); err != nil {
+		r.frame = -1
+		return err
+	}
+	r.frame = i
+	return nil
+}
+
+func (r *gzReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.idx.size
+	default:
+		return r.off, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return r.off, errors.New("negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// testText returns size bytes of compressible text that differs at every
+// offset, so reads from the wrong position are noticed
+func testText(size int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < size; i++ {
+		fmt.Fprintf(&buf, "line %d\n", i)
+	}
+	return buf.Bytes()[:size]
+}
+
+func TestRoundTrip(t *testing.T) {
+	text := testText(2*gzFrameSize + 12345)
+	photo := testJpeg(t, testExif(6))
+	stripped, _, err := strip(t, photo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an uncompressed PNG is large enough to be worth compressing
+	var pngData bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.NoCompression}
+	if err := enc.Encode(&pngData, image.NewGray(image.Rect(0, 0, 512, 512))); err != nil {
+		t.Fatal(err)
+	}
+	ihdr := len(pngSig) + 12 + 13
+	bigPhoto := append(append(append([]byte{}, pngData.Bytes()[:ihdr]...), pngChunk("eXIf", testExif(6))...), pngData.Bytes()[ihdr:]...)
+	bigStripped, _, err := strip(t, bigPhoto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		file       string
+		data, want []byte
+		encrypt    bool
+		compress   bool
+		opts       Options
+	}{
+		{"plain", "a.txt", text, text, false, false, Options{}},
+		{"compressed", "a.txt", text, text, false, true, Options{}},
+		{"encrypted", "a.txt", text, text, true, false, Options{}},
+		{"compressed and encrypted", "a.txt", text, text, true, true, Options{}},
+		{"stripped", "a.jpg", photo, stripped, false, false, Options{StripMetadata: true}},
+		{"stripped, compressed and encrypted", "a.png", bigPhoto, bigStripped, true, true, Options{StripMetadata: true}},
+	}
+	for _, test := range tests {
+		s, _ := newTestStorage(t)
+		if test.encrypt {
+			s.Keys = testKeyring(t, 1)
+		}
+		if test.compress {
+			s.CompressMin = 1
+			s.CompressMime = []string{"text/", "image/"}
+		} else {
+			s.CompressMin = 0
+		}
+		id, _, size, _, err := s.New(bytes.NewReader(test.data), test.file, test.opts)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if size != int64(len(test.want)) {
+			t.Errorf("%s: New returned size %d, want %d", test.name, size, len(test.want))
+		}
+
+		f, _, size, _, err := s.Get(id)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if size != int64(len(test.want)) {
+			t.Errorf("%s: Get returned size %d, want %d", test.name, size, len(test.want))
+		}
+		if data, err := ioutil.ReadAll(f); err != nil || !bytes.Equal(data, test.want) {
+			t.Errorf("%s: read %d bytes (%v), want %d", test.name, len(data), err, len(test.want))
+		}
+		if (f.Gzip() != nil) != test.compress {
+			t.Errorf("%s: stored compressed = %v", test.name, f.Gzip() != nil)
+		}
+		if gz := f.Gzip(); gz != nil {
+			if _, err := gz.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			zr, err := gzip.NewReader(gz)
+			if err != nil {
+				t.Errorf("%s: gzip stream: %s", test.name, err)
+			} else if data, err := ioutil.ReadAll(zr); err != nil || !bytes.Equal(data, test.want) {
+				t.Errorf("%s: gzip stream has %d bytes (%v), want %d", test.name, len(data), err, len(test.want))
+			}
+		}
+
+		// ranges starting in any frame, across frame boundaries and
+		// relative to the end, as used for HTTP range requests
+		n := int64(len(test.want))
+		ranges := []struct {
+			offset int64
+			whence int
+			length int64
+		}{
+			{0, io.SeekStart, 10},
+			{gzFrameSize - 5, io.SeekStart, 10},
+			{2*gzFrameSize + 100, io.SeekStart, 1000},
+			{n / 2, io.SeekStart, 1},
+			{-7, io.SeekEnd, 7},
+			{3, io.SeekStart, n - 3},
+		}
+		for _, r := range ranges {
+			start := r.offset
+			if r.whence == io.SeekEnd {
+				start += n
+			}
+			if start < 0 || start+r.length > n {
+				continue
+			}
+			pos, err := f.Seek(r.offset, r.whence)
+			if err != nil || pos != start {
+				t.Errorf("%s: Seek(%d, %d) = %d, %v", test.name, r.offset, r.whence, pos, err)
+				continue
+			}
+			buf := make([]byte, r.length)
+			if _, err := io.ReadFull(f, buf); err != nil {
+				t.Errorf("%s: reading %d bytes at %d: %s", test.name, r.length, start, err)
+			} else if !bytes.Equal(buf, test.want[start:start+r.length]) {
+				t.Errorf("%s: wrong %d bytes at %d", test.name, r.length, start)
+			}
+		}
+		f.Close()
+
+		_, blob, _ := s.lookup(id)
+		raw, err := ioutil.ReadFile(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.encrypt && bytes.Contains(raw, test.want[:64]) {
+			t.Errorf("%s: blob is stored in plaintext", test.name)
+		}
+		if test.compress && len(test.want) > 1000 && int64(len(raw)) >= n {
+			t.Errorf("%s: blob is %d bytes for %d bytes of contents", test.name, len(raw), n)
+		}
+	}
+}
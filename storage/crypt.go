@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// encrypted blob layout:
+//
+//	header: magic[8] keyid[8] chunksize[4] size[8] nonce[12] wrapped data key[48]
+//	chunks: AES-256-GCM sealed chunks of chunksize plaintext bytes, nonce = chunk index
+//
+// the header is authenticated as additional data of the wrapped data key, so
+// rotating the master key only rewrites the header
+const (
+	cryptMagic      = "GOMFENC1"
+	cryptChunkSize  = 64 * 1024
+	cryptHeaderSize = 40 + 32 + 16
+	cryptOverhead   = 16
+)
+
+var ErrNoKey = errors.New("file is encrypted with an unknown key")
+
+type masterKey struct {
+	id   [8]byte
+	aead cipher.AEAD
+}
+
+type Keyring struct {
+	keys []masterKey
+}
+
+// LoadKeyring reads hex-encoded 256-bit keys, one per line; the first one is
+// used for new files, the rest are only used for decryption
+func LoadKeyring(fname string) (*Keyring, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	k := &Keyring{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("invalid key in " + fname + ": must be 64 hex digits")
+		}
+		if err = k.add(key); err != nil {
+			return nil, err
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(k.keys) == 0 {
+		return nil, errors.New("no keys in " + fname)
+	}
+	return k, nil
+}
+
+func (k *Keyring) add(key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	mk := masterKey{aead: aead}
+	sum := sha256.Sum256(key)
+	copy(mk.id[:], sum[:])
+	k.keys = append(k.keys, mk)
+	return nil
+}
+
+func (k *Keyring) primary() *masterKey {
+	return &k.keys[0]
+}
+
+func (k *Keyring) find(id []byte) *masterKey {
+	for i := range k.keys {
+		if string(k.keys[i].id[:]) == string(id) {
+			return &k.keys[i]
+		}
+	}
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (k *Keyring) sealHeader(dek []byte, chunkSize int, size int64) ([]byte, error) {
+	mk := k.primary()
+	h := make([]byte, 40, cryptHeaderSize)
+	copy(h, cryptMagic)
+	copy(h[8:16], mk.id[:])
+	binary.BigEndian.PutUint32(h[16:20], uint32(chunkSize))
+	binary.BigEndian.PutUint64(h[20:28], uint64(size))
+	if _, err := io.ReadFull(crand.Reader, h[28:40]); err != nil {
+		return nil, err
+	}
+	return mk.aead.Seal(h, h[28:40], dek, h[:28]), nil
+}
+
+func (k *Keyring) openHeader(h []byte) (dek []byte, chunkSize int, size int64, err error) {
+	if k == nil {
+		err = ErrNoKey
+		return
+	}
+	mk := k.find(h[8:16])
+	if mk == nil {
+		err = ErrNoKey
+		return
+	}
+	dek, err = mk.aead.Open(nil, h[28:40], h[40:], h[:28])
+	if err != nil {
+		err = errors.New("corrupted encryption header")
+		return
+	}
+	chunkSize = int(binary.BigEndian.Uint32(h[16:20]))
+	size = int64(binary.BigEndian.Uint64(h[20:28]))
+	return
+}
+
+// encrypted blobs are marked by an empty file named after the blob with
+// cryptMarkerExt appended, since plaintext uploads may start with anything
+const cryptMarkerExt = ".enc"
+
+// isEncrypted reports whether the blob at fpath is encrypted
+func (s *Storage) isEncrypted(fpath string) bool {
+	_, err := os.Stat(fpath + cryptMarkerExt)
+	return err == nil
+}
+
+func markEncrypted(fpath string) error {
+	f, err := os.OpenFile(fpath+cryptMarkerExt, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func chunkNonce(i int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(i))
+	return nonce
+}
+
+type cryptWriter struct {
+	f    *os.File
+	keys *Keyring
+	dek  []byte
+	aead cipher.AEAD
+	buf  []byte
+	n    int64
+	size int64
+}
+
+// newCryptWriter encrypts everything written to it into f; the header is only
+// valid after Close, which does not close f
+func newCryptWriter(f *os.File, keys *Keyring) (*cryptWriter, error) {
+	dek := make([]byte, 32)
+	if _, err := io.ReadFull(crand.Reader, dek); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.Write(make([]byte, cryptHeaderSize)); err != nil {
+		return nil, err
+	}
+	return &cryptWriter{
+		f:    f,
+		keys: keys,
+		dek:  dek,
+		aead: aead,
+		buf:  make([]byte, 0, cryptChunkSize+cryptOverhead),
+	}, nil
+}
+
+func (w *cryptWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		m := cryptChunkSize - len(w.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		w.buf = append(w.buf, p[:m]...)
+		p = p[m:]
+		n += m
+		if len(w.buf) == cryptChunkSize {
+			if err = w.flush(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (w *cryptWriter) flush() error {
+	w.size += int64(len(w.buf))
+	_, err := w.f.Write(w.aead.Seal(w.buf[:0], chunkNonce(w.n), w.buf, nil))
+	w.n++
+	w.buf = w.buf[:0]
+	return err
+}
+
+func (w *cryptWriter) Close() error {
+	if len(w.buf) > 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	h, err := w.keys.sealHeader(w.dek, cryptChunkSize, w.size)
+	if err != nil {
+		return err
+	}
+	_, err = w.f.WriteAt(h, 0)
+	return err
+}
+
+type cryptReader struct {
+	f         io.ReaderAt
+	aead      cipher.AEAD
+	chunkSize int
+	size      int64
+	off       int64
+	chunk     int64
+	buf       []byte
+}
+
+func newCryptReader(f io.ReaderAt, keys *Keyring) (*cryptReader, error) {
+	h := make([]byte, cryptHeaderSize)
+	if _, err := f.ReadAt(h, 0); err != nil {
+		return nil, err
+	}
+	dek, chunkSize, size, err := keys.openHeader(h)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	return &cryptReader{
+		f:         f,
+		aead:      aead,
+		chunkSize: chunkSize,
+		size:      size,
+		chunk:     -1,
+	}, nil
+}
+
+func (r *cryptReader) Read(p []byte) (n int, err error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	i := r.off / int64(r.chunkSize)
+	if i != r.chunk {
+		if err = r.load(i); err != nil {
+			return
+		}
+	}
+	n = copy(p, r.buf[r.off-i*int64(r.chunkSize):])
+	r.off += int64(n)
+	return
+}
+
+func (r *cryptReader) load(i int64) error {
+	n := int64(r.chunkSize)
+	if rest := r.size - i*n; rest < n {
+		n = rest
+	}
+	ct := make([]byte, n+cryptOverhead)
+	if _, err := r.f.ReadAt(ct, cryptHeaderSize+i*int64(r.chunkSize+cryptOverhead)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	pt, err := r.aead.Open(ct[:0], chunkNonce(i), ct, nil)
+	if err != nil {
+		return errors.New("corrupted encrypted chunk")
+	}
+	r.chunk = i
+	r.buf = pt
+	return nil
+}
+
+func (r *cryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return r.off, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return r.off, errors.New("negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+// rewrapHeader returns the header of an encrypted file with its data key
+// re-encrypted with the primary key; it returns nil if the file already uses it
+func (k *Keyring) rewrapHeader(f io.ReaderAt) ([]byte, error) {
+	h := make([]byte, cryptHeaderSize)
+	if _, err := f.ReadAt(h, 0); err != nil {
+		return nil, err
+	}
+	if string(h[8:16]) == string(k.primary().id[:]) {
+		return nil, nil
+	}
+	dek, chunkSize, size, err := k.openHeader(h)
+	if err != nil {
+		return nil, err
+	}
+	return k.sealHeader(dek, chunkSize, size)
+}
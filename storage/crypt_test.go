@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func testKeyring(t *testing.T, seed byte) *Keyring {
+	k := &Keyring{}
+	if err := k.add(bytes.Repeat([]byte{seed}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func readAll(t *testing.T, s *Storage, id string) string {
+	f, _, _, _, err := s.Get(id)
+	if err != nil {
+		t.Fatalf("Get(%s): %s", id, err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("reading %s: %s", id, err)
+	}
+	return string(data)
+}
+
+func TestPlaintextWithCryptMagic(t *testing.T) {
+	content := cryptMagic + strings.Repeat("\x00", cryptHeaderSize) + "not actually encrypted"
+	for _, keys := range []*Keyring{nil, testKeyring(t, 1)} {
+		s, _ := newTestStorage(t)
+		// stored before encryption was enabled
+		id, _, _, _, err := s.New(strings.NewReader(content), "magic.bin", Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Keys = keys
+		if got := readAll(t, s, id); got != content {
+			t.Errorf("keys %v: got %q, want %q", keys != nil, got, content)
+		}
+	}
+}
+
+func TestEncryptedRoundTrip(t *testing.T) {
+	s, _ := newTestStorage(t)
+	s.Keys = testKeyring(t, 1)
+	content := strings.Repeat("secret data ", 20000)
+	id, _, _, _, err := s.New(strings.NewReader(content), "a.txt", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, s, id); got != content {
+		t.Errorf("decrypted content differs")
+	}
+	_, blob, _ := s.lookup(id)
+	raw, _ := ioutil.ReadFile(blob)
+	if bytes.Contains(raw, []byte("secret data")) {
+		t.Errorf("blob is stored in plaintext")
+	}
+
+	// a plaintext upload that looks encrypted must still be readable
+	magic := cryptMagic + "plaintext"
+	s.Keys = nil
+	mid, _, _, _, err := s.New(strings.NewReader(magic), "m.txt", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Keys = testKeyring(t, 1)
+	if got := readAll(t, s, mid); got != magic {
+		t.Errorf("got %q, want %q", got, magic)
+	}
+}
+
+func TestRekeySkipsFailures(t *testing.T) {
+	s, _ := newTestStorage(t)
+	// encrypted with a key that is later lost
+	s.Keys = testKeyring(t, 9)
+	lost, _, _, _, err := s.New(strings.NewReader("lost key"), "lost.txt", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Keys = nil
+	plain := map[string]string{}
+	for _, content := range []string{"first", cryptMagic + " second", "third"} {
+		id, _, _, _, err := s.New(strings.NewReader(content), "p.txt", Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		plain[id] = content
+	}
+
+	s.Keys = testKeyring(t, 1)
+	failed := []string{}
+	n, err := s.Rekey(func(fpath string, err error) { failed = append(failed, fpath) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(plain) {
+		t.Errorf("re-encrypted %d files, want %d", n, len(plain))
+	}
+	if _, blob, _ := s.lookup(lost); len(failed) != 1 || failed[0] != blob {
+		t.Errorf("failed files %v, want only %s", failed, blob)
+	}
+	for id, content := range plain {
+		if got := readAll(t, s, id); got != content {
+			t.Errorf("%s: got %q, want %q", id, got, content)
+		}
+		_, blob, _ := s.lookup(id)
+		raw, _ := ioutil.ReadFile(blob)
+		if bytes.Contains(raw, []byte(content)) {
+			t.Errorf("%s was not encrypted", id)
+		}
+	}
+}
+
+func TestRekeyRewrap(t *testing.T) {
+	s, _ := newTestStorage(t)
+	s.Keys = testKeyring(t, 1)
+	content := strings.Repeat("rewrapped ", 20000)
+	id, _, _, _, err := s.New(strings.NewReader(content), "a.txt", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, blob, _ := s.lookup(id)
+	old, err := os.Open(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	before, _ := ioutil.ReadFile(blob)
+
+	s.Keys = testKeyring(t, 2)
+	if err = s.Keys.add(bytes.Repeat([]byte{1}, 32)); err != nil {
+		t.Fatal(err)
+	}
+	n, err := s.Rekey(func(fpath string, err error) { t.Errorf("%s: %s", fpath, err) })
+	if err != nil || n != 1 {
+		t.Fatalf("Rekey = %d, %v, want 1", n, err)
+	}
+	after, _ := ioutil.ReadFile(blob)
+	if string(after[8:16]) != string(s.Keys.primary().id[:]) {
+		t.Error("header was not rewrapped with the primary key")
+	}
+	if !bytes.Equal(after[cryptHeaderSize:], before[cryptHeaderSize:]) {
+		t.Error("rewrapping changed the encrypted chunks")
+	}
+	// the blob is replaced, not rewritten in place
+	h := make([]byte, cryptHeaderSize)
+	if _, err = old.ReadAt(h, 0); err != nil || !bytes.Equal(h, before[:cryptHeaderSize]) {
+		t.Error("header of the old blob was overwritten")
+	}
+	s.Keys = testKeyring(t, 2)
+	if got := readAll(t, s, id); got != content {
+		t.Error("rewrapped content differs")
+	}
+	if n, err = s.Rekey(func(string, error) {}); err != nil || n != 0 {
+		t.Errorf("second Rekey = %d, %v, want 0", n, err)
+	}
+}
+
+func TestEncryptedWithoutMarker(t *testing.T) {
+	s, _ := newTestStorage(t)
+	s.Keys = testKeyring(t, 1)
+	id, _, _, _, err := s.New(strings.NewReader("secret"), "a.txt", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, blob, _ := s.lookup(id)
+	raw, _ := ioutil.ReadFile(blob)
+	if err = os.Remove(blob + cryptMarkerExt); err != nil {
+		t.Fatal(err)
+	}
+	// the marker is the only sign of encryption, even if the header
+	// authenticates with a known key
+	if got := readAll(t, s, id); got != string(raw) {
+		t.Errorf("blob without a marker was decrypted to %q", got)
+	}
+}
@@ -0,0 +1,243 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+type Info struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	Size      int64     `json:"size"`
+	Time      time.Time `json:"time"`
+	Mime      string    `json:"mime"`
+	Encrypted bool      `json:"encrypted,omitempty"`
+	Downloads int64     `json:"downloads"`
+	Ids       []string  `json:"ids,omitempty"`
+}
+
+type Stats struct {
+	Blobs        int   `json:"blobs"`
+	Ids          int   `json:"ids"`
+	Bytes        int64 `json:"bytes"`
+	DiskBytes    int64 `json:"disk_bytes"`
+	LogicalBytes int64 `json:"logical_bytes"`
+	DedupSavings int64 `json:"dedup_savings"`
+}
+
+// Info returns information about an uploaded file, including all IDs that
+// refer to the same file; finding those walks all IDs, so public handlers
+// should use FileInfo
+func (s *Storage) Info(idext string) (*Info, error) {
+	info, err := s.info(idext, true)
+	if err != nil {
+		return nil, err
+	}
+	bhash := path.Base(s.blobFolder(info.Hash))
+	info.Ids, err = s.idsByHash(bhash)
+	return info, err
+}
+
+// FileInfo returns information about an uploaded file without the IDs that
+// refer to the same file
+func (s *Storage) FileInfo(idext string) (*Info, error) {
+	return s.info(idext, true)
+}
+
+func (s *Storage) info(idext string, detectMime bool) (*Info, error) {
+	link, blob, err := s.lookup(idext)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Lstat(link)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := base64ToHex(path.Base(path.Dir(blob)))
+	if err != nil {
+		return nil, err
+	}
+	meta, err := s.GetMeta(idext)
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.openBlob(blob, link)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info := &Info{
+		Id:        idext,
+		Name:      path.Base(link),
+		Hash:      hash,
+		Size:      f.Size(),
+		Time:      stat.ModTime(),
+		Mime:      meta.Mime,
+		Encrypted: meta.Encrypted,
+		Downloads: meta.Downloads,
+	}
+	if info.Mime == "" && !meta.Encrypted && detectMime {
+		// files uploaded before MIME types were recorded
+		buf := make([]byte, 64*1024)
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		if info.Mime, err = GetMimeTypeBuffer(buf[:n]); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// Walk calls fn for every ID that refers to a stored file, in no particular
+// order; the Ids field of the infos is not set; if onError is set, IDs whose
+// information cannot be read (e.g. ErrNoKey) are passed to it and skipped
+// instead of stopping the walk
+func (s *Storage) Walk(detectMime bool, fn func(*Info) error, onError func(id string, err error)) error {
+	return filepath.Walk(path.Join(s.Folder, "ids"), func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			return err
+		}
+		id := path.Base(path.Dir(fpath)) + path.Ext(fpath)
+		info, err := s.info(id, detectMime)
+		if os.IsNotExist(err) {
+			return nil // removed by Block
+		} else if err != nil && onError != nil {
+			onError(id, err)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return fn(info)
+	})
+}
+
+// WalkLinks is like Walk, but only sets the Id, Name, Hash and Time fields of
+// the infos, which are known without opening the stored files
+func (s *Storage) WalkLinks(fn func(*Info) error) error {
+	return filepath.Walk(path.Join(s.Folder, "ids"), func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			return err
+		}
+		if _, err = os.Stat(fpath); os.IsNotExist(err) {
+			return nil // removed by Block
+		}
+		target, err := os.Readlink(fpath)
+		if err != nil {
+			return err
+		}
+		hash, err := base64ToHex(path.Base(path.Dir(target)))
+		if err != nil {
+			return err
+		}
+		return fn(&Info{
+			Id:   path.Base(path.Dir(fpath)) + path.Ext(fpath),
+			Name: path.Base(fpath),
+			Hash: hash,
+			Time: fi.ModTime(),
+		})
+	})
+}
+
+// Remove removes an ID, and the stored file if no other IDs refer to it
+func (s *Storage) Remove(idext string) error {
+	_, blob, err := s.lookup(idext)
+	if err != nil {
+		return err
+	}
+	if err = s.removeId(idext); err != nil {
+		return err
+	}
+	ids, err := s.idsByHash(path.Base(path.Dir(blob)))
+	if err != nil || len(ids) > 0 {
+		return err
+	}
+	return os.RemoveAll(path.Dir(blob))
+}
+
+// RemoveHash removes the stored file with the given hex-encoded hash and all
+// IDs that refer to it
+func (s *Storage) RemoveHash(hash string) (ids []string, err error) {
+	folder := s.blobFolder(hash)
+	if folder == "" {
+		return nil, errors.New("invalid hash: " + hash)
+	}
+	if ids, err = s.idsByHash(path.Base(folder)); err != nil {
+		return
+	}
+	if _, err = os.Stat(folder); os.IsNotExist(err) && len(ids) == 0 {
+		return nil, ErrNotFound{hash}
+	}
+	for _, id := range ids {
+		if err = s.removeId(id); err != nil {
+			return
+		}
+	}
+	err = os.RemoveAll(folder)
+	return
+}
+
+func (s *Storage) removeId(idext string) error {
+	id, _, err := s.splitId(idext)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(s.metaPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = s.removeReports(id); err != nil {
+		return err
+	}
+	s.dropDownloads(id)
+	return os.RemoveAll(s.idToFolder("ids", id))
+}
+
+// blobFolder returns the folder of the stored file with the given
+// hex-encoded hash
+func (s *Storage) blobFolder(hash string) string {
+	b, err := hex.DecodeString(hash)
+	if err != nil || len(b) == 0 {
+		return ""
+	}
+	return s.idToFolder("files", base64.RawURLEncoding.EncodeToString(b))
+}
+
+// Stats returns storage usage; IDs whose files cannot be read are left out
+// of the ID and byte counts
+func (s *Storage) Stats() (stats Stats, err error) {
+	sizes := make(map[string]int64)
+	err = s.Walk(false, func(info *Info) error {
+		stats.Ids++
+		stats.LogicalBytes += info.Size
+		sizes[info.Hash] = info.Size
+		return nil
+	}, func(string, error) {})
+	if err != nil {
+		return
+	}
+	for _, size := range sizes {
+		stats.Bytes += size
+	}
+	stats.DedupSavings = stats.LogicalBytes - stats.Bytes
+
+	err = filepath.Walk(path.Join(s.Folder, "files"), func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		if fi.Name() == "file" {
+			stats.Blobs++
+		}
+		stats.DiskBytes += fi.Size()
+		return nil
+	})
+	return
+}
@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestInfo(t *testing.T) {
+	s, _ := newTestStorage(t)
+	var ids []string
+	for _, name := range []string{"a.txt", "b.txt"} {
+		id, _, _, _, err := s.New(strings.NewReader("same contents"), name, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	fi, err := s.FileInfo(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Name != "a.txt" || fi.Size != 13 || fi.Mime != "text/plain" || fi.Ids != nil {
+		t.Errorf("FileInfo = %+v", fi)
+	}
+
+	info, err := s.Info(ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ids)
+	sort.Strings(info.Ids)
+	if info.Name != "b.txt" || info.Hash != fi.Hash || !reflect.DeepEqual(info.Ids, ids) {
+		t.Errorf("Info = %+v, want IDs %v", info, ids)
+	}
+}
+
+func TestWalkLinks(t *testing.T) {
+	s, _ := newTestStorage(t)
+	want := map[string]*Info{}
+	for _, name := range []string{"a.txt", "b.png", "c"} {
+		id, _, _, _, err := s.New(strings.NewReader("contents of "+name), name, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want[id], err = s.FileInfo(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := 0
+	err := s.WalkLinks(func(info *Info) error {
+		n++
+		w := want[info.Id]
+		if w == nil || info.Name != w.Name || info.Hash != w.Hash || !info.Time.Equal(w.Time) {
+			t.Errorf("WalkLinks returned %+v, want %+v", info, w)
+		}
+		return nil
+	})
+	if err != nil || n != len(want) {
+		t.Errorf("WalkLinks walked %d IDs, want %d: %v", n, len(want), err)
+	}
+}
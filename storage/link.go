@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// short links are stored as links/<ii>/<ii>/<id>/link.json, so their IDs are
+// allocated like file IDs but never collide with them
+
+type Link struct {
+	Url     string    `json:"url"`
+	Created time.Time `json:"created"`
+	// Expires is the zero time for links that do not expire
+	Expires time.Time `json:"expires"`
+}
+
+func (l Link) Expired() bool {
+	return !l.Expires.IsZero() && time.Now().After(l.Expires)
+}
+
+// namespaceFolder returns the folder of an ID allocated in a subfolder with
+// allocId
+func (s *Storage) namespaceFolder(subfolder, id string) (string, error) {
+	// no link can exist under an invalid ID
+	if id == "" {
+		return "", ErrNotFound{id}
+	}
+	for i := 0; i < len(id); i++ {
+		if strings.IndexByte(s.IdCharset, id[i]) < 0 {
+			return "", ErrNotFound{id}
+		}
+	}
+	return s.idToFolder(subfolder, id), nil
+}
+
+// NewLink stores a short link to a URL under a new ID; a zero expires time
+// means it never expires
+func (s *Storage) NewLink(url string, expires time.Time) (id string, err error) {
+	data, err := json.Marshal(Link{Url: url, Created: time.Now().UTC(), Expires: expires.UTC()})
+	if err != nil {
+		return
+	}
+	id, dir, err := s.allocId("links")
+	if err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(path.Join(dir, "link.json"), data, 0644); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return id, nil
+}
+
+// GetLink returns the short link with the given ID; expired links are
+// removed and reported as not found
+func (s *Storage) GetLink(id string) (link Link, err error) {
+	dir, err := s.namespaceFolder("links", id)
+	if err != nil {
+		return
+	}
+	data, err := ioutil.ReadFile(path.Join(dir, "link.json"))
+	if os.IsNotExist(err) {
+		return link, ErrNotFound{id}
+	} else if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &link); err != nil {
+		return
+	}
+	if link.Expired() {
+		os.RemoveAll(dir)
+		return Link{}, ErrNotFound{id}
+	}
+	return
+}
+
+// RemoveLink removes a short link
+func (s *Storage) RemoveLink(id string) error {
+	dir, err := s.namespaceFolder("links", id)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(dir); os.IsNotExist(err) {
+		return ErrNotFound{id}
+	}
+	return os.RemoveAll(dir)
+}
+
+// RemoveExpiredLinks removes the short links that have expired and returns
+// how many were removed; links are otherwise only removed when they are
+// accessed after expiring
+func (s *Storage) RemoveExpiredLinks() (n int, err error) {
+	err = filepath.Walk(path.Join(s.Folder, "links"), func(fpath string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil || info.IsDir() || info.Name() != "link.json" {
+			return err
+		}
+		data, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			return err
+		}
+		var link Link
+		if err = json.Unmarshal(data, &link); err != nil {
+			return errors.New(fpath + ": " + err.Error())
+		}
+		if link.Expired() {
+			if err = os.RemoveAll(path.Dir(fpath)); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	return
+}
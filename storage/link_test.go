@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func isNotFound(err error) bool {
+	_, ok := err.(ErrNotFound)
+	return ok
+}
+
+func TestLinks(t *testing.T) {
+	s, _ := newTestStorage(t)
+	id, err := s.NewLink("https://example.org/a", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := s.GetLink(id)
+	if err != nil || link.Url != "https://example.org/a" || !link.Expires.IsZero() || link.Expired() {
+		t.Errorf("GetLink = %+v, %v", link, err)
+	}
+	// links do not share IDs with files
+	if _, _, _, _, err = s.Get(id); !isNotFound(err) {
+		t.Errorf("Get of a link ID: %v", err)
+	}
+	for _, invalid := range []string{"", "../" + id, "zz/zz", "!!!!"} {
+		if _, err = s.GetLink(invalid); !isNotFound(err) {
+			t.Errorf("GetLink(%q): %v, want ErrNotFound", invalid, err)
+		}
+	}
+
+	expired, err := s.NewLink("https://example.org/b", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.GetLink(expired); !isNotFound(err) {
+		t.Errorf("GetLink of an expired link: %v", err)
+	}
+	if _, err = os.Stat(s.idToFolder("links", expired)); !os.IsNotExist(err) {
+		t.Error("expired link was not removed when accessed")
+	}
+
+	if err = s.RemoveLink(id); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.RemoveLink(id); !isNotFound(err) {
+		t.Errorf("removing a removed link: %v", err)
+	}
+	if _, err = s.GetLink(id); !isNotFound(err) {
+		t.Errorf("GetLink of a removed link: %v", err)
+	}
+}
+
+func TestRemoveExpiredLinks(t *testing.T) {
+	s, _ := newTestStorage(t)
+	if n, err := s.RemoveExpiredLinks(); err != nil || n != 0 {
+		t.Errorf("without links: %d, %v", n, err)
+	}
+	now := time.Now()
+	var expired, kept []string
+	for _, expires := range []time.Time{now.Add(-time.Hour), now.Add(-time.Second), now.Add(time.Hour), {}} {
+		id, err := s.NewLink("https://example.org/", expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !expires.IsZero() && expires.Before(now) {
+			expired = append(expired, id)
+		} else {
+			kept = append(kept, id)
+		}
+	}
+	// an ID allocated for a link that is still being written
+	_, allocated, err := s.allocId("links")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := s.RemoveExpiredLinks(); err != nil || n != len(expired) {
+		t.Errorf("RemoveExpiredLinks = %d, %v, want %d", n, err, len(expired))
+	}
+	for _, id := range expired {
+		if _, err := os.Stat(s.idToFolder("links", id)); !os.IsNotExist(err) {
+			t.Errorf("expired link %s was not removed", id)
+		}
+	}
+	for _, id := range kept {
+		if _, err := s.GetLink(id); err != nil {
+			t.Errorf("link %s: %s", id, err)
+		}
+	}
+	if _, err := os.Stat(allocated); err != nil {
+		t.Errorf("allocated link folder %s: %s", path.Base(allocated), err)
+	}
+}
@@ -5,9 +5,14 @@ package storage
 // #include <magic.h>
 import "C"
 import "errors"
+import "sync"
 import "unsafe"
 
-var magic C.magic_t
+// magic is not thread-safe, so it is only used while holding magicLock
+var (
+	magic     C.magic_t
+	magicLock sync.Mutex
+)
 
 func init() {
 	magic = C.magic_open(C.MAGIC_MIME_TYPE | C.MAGIC_SYMLINK | C.MAGIC_ERROR)
@@ -23,9 +28,24 @@ func init() {
 func GetMimeType(fname string) (string, error) {
 	cfname := C.CString(fname)
 	defer C.free(unsafe.Pointer(cfname))
+	magicLock.Lock()
+	defer magicLock.Unlock()
 	mime := C.magic_file(magic, cfname)
 	if mime == nil {
 		return "", errors.New(C.GoString(C.magic_error(magic)))
 	}
 	return C.GoString(mime), nil
 }
+
+func GetMimeTypeBuffer(buf []byte) (string, error) {
+	if len(buf) == 0 {
+		return "application/x-empty", nil
+	}
+	magicLock.Lock()
+	defer magicLock.Unlock()
+	mime := C.magic_buffer(magic, unsafe.Pointer(&buf[0]), C.size_t(len(buf)))
+	if mime == nil {
+		return "", errors.New(C.GoString(C.magic_error(magic)))
+	}
+	return C.GoString(mime), nil
+}
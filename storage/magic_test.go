@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestGetMimeTypeBufferConcurrent(t *testing.T) {
+	tests := []struct {
+		data, mime string
+	}{
+		{"hello world\n", "text/plain"},
+		{"%PDF-1.4\n", "application/pdf"},
+		{"GIF89a\x01\x00\x01\x00\x00\x00\x00", "image/gif"},
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				test := tests[j%len(tests)]
+				mime, err := GetMimeTypeBuffer([]byte(test.data))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if mime != test.mime {
+					t.Errorf("GetMimeTypeBuffer(%q) = %q, want %q", test.data, mime, test.mime)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
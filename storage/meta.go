@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// Meta holds per-ID information that cannot be derived from the stored file
+type Meta struct {
+	Encrypted bool   `json:"encrypted,omitempty"`
+	Mime      string `json:"mime,omitempty"`
+	Disabled  bool   `json:"disabled,omitempty"`
+	Downloads int64  `json:"downloads,omitempty"`
+}
+
+func (s *Storage) metaPath(id string) string {
+	return s.idToFolder("meta", id) + ".json"
+}
+
+// GetMeta returns the metadata of an ID; IDs stored without metadata have a
+// zero Meta
+func (s *Storage) GetMeta(idext string) (meta Meta, err error) {
+	id, _, err := s.splitId(idext)
+	if err != nil {
+		return
+	}
+	if meta, err = s.readMeta(id); err != nil {
+		return
+	}
+	s.downloadLock.Lock()
+	if c := s.downloads[id]; c != nil {
+		meta.Downloads += c.pending
+	}
+	s.downloadLock.Unlock()
+	return
+}
+
+// readMeta returns the stored metadata of an ID, without downloads that have
+// not been flushed yet
+func (s *Storage) readMeta(id string) (meta Meta, err error) {
+	data, err := ioutil.ReadFile(s.metaPath(id))
+	if os.IsNotExist(err) {
+		return meta, nil
+	} else if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &meta)
+	return
+}
+
+func (s *Storage) setMeta(id string, meta Meta) error {
+	fpath := s.metaPath(id)
+	if meta == (Meta{}) {
+		if err := os.Remove(fpath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fpath, data)
+}
+
+// writeFileAtomic writes data to a temporary file next to fpath and renames
+// it to fpath, so readers never see a partial file
+func writeFileAtomic(fpath string, data []byte) error {
+	os.MkdirAll(path.Dir(fpath), 0755)
+	temp, err := ioutil.TempFile(path.Dir(fpath), ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(data)
+	if cerr := temp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), fpath)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
+
+// downloadCount is the download count of an ID kept in memory, split into
+// the count in the stored metadata and the downloads not yet written to it
+type downloadCount struct {
+	stored, pending int64
+}
+
+// AddDownload increments the download count of an ID and returns the new
+// count; the stored count is only read on the first download of an ID, and
+// new downloads are kept in memory until FlushDownloads writes them
+func (s *Storage) AddDownload(idext string) (int64, error) {
+	id, _, err := s.splitId(idext)
+	if err != nil {
+		return 0, err
+	}
+	s.downloadLock.Lock()
+	c := s.downloads[id]
+	s.downloadLock.Unlock()
+	if c == nil {
+		meta, err := s.readMeta(id)
+		if err != nil {
+			return 0, err
+		}
+		c = &downloadCount{stored: meta.Downloads}
+	}
+
+	s.downloadLock.Lock()
+	defer s.downloadLock.Unlock()
+	if s.downloads == nil {
+		s.downloads = make(map[string]*downloadCount)
+	}
+	// a concurrent first download may have added it already
+	if cur := s.downloads[id]; cur != nil {
+		c = cur
+	} else {
+		s.downloads[id] = c
+	}
+	c.pending++
+	return c.stored + c.pending, nil
+}
+
+// FlushDownloads adds the download counts kept in memory to the stored
+// metadata; counts of IDs that were removed in the meantime are dropped
+func (s *Storage) FlushDownloads() error {
+	s.downloadLock.Lock()
+	pending := make(map[string]int64, len(s.downloads))
+	for id, c := range s.downloads {
+		if c.pending > 0 {
+			pending[id] = c.pending
+		}
+	}
+	s.downloadLock.Unlock()
+
+	var firstErr error
+	for id, n := range pending {
+		stored, err := s.flushDownloads(id, n)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		s.downloadLock.Lock()
+		if c := s.downloads[id]; c != nil {
+			c.stored = stored
+			c.pending -= n
+		}
+		s.downloadLock.Unlock()
+	}
+	return firstErr
+}
+
+// flushDownloads adds n downloads to the stored metadata of an ID and returns
+// the new stored count
+func (s *Storage) flushDownloads(id string, n int64) (int64, error) {
+	s.metaLock.Lock()
+	defer s.metaLock.Unlock()
+	if _, err := os.Stat(s.idToFolder("ids", id)); os.IsNotExist(err) {
+		return 0, nil
+	}
+	meta, err := s.readMeta(id)
+	if err != nil {
+		return 0, err
+	}
+	meta.Downloads += n
+	return meta.Downloads, s.setMeta(id, meta)
+}
+
+// dropDownloads forgets the unflushed download count of a removed ID
+func (s *Storage) dropDownloads(id string) {
+	s.downloadLock.Lock()
+	delete(s.downloads, id)
+	s.downloadLock.Unlock()
+}
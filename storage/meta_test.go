@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDownloads(t *testing.T) {
+	s, _ := newTestStorage(t)
+	id, _, _, _, err := s.New(strings.NewReader("data"), "a.txt", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bare := strings.TrimSuffix(id, ".txt")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.AddDownload(id); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if meta, _ := s.readMeta(bare); meta.Downloads != 0 {
+		t.Error("downloads were written before flushing")
+	}
+	if meta, _ := s.GetMeta(id); meta.Downloads != 50 {
+		t.Errorf("downloads before flushing = %d, want 50", meta.Downloads)
+	}
+
+	if err = s.FlushDownloads(); err != nil {
+		t.Fatal(err)
+	}
+	if meta, _ := s.readMeta(bare); meta.Downloads != 50 {
+		t.Errorf("flushed downloads = %d, want 50", meta.Downloads)
+	}
+
+	// the stored count is only read on the first download
+	mpath := s.metaPath(bare)
+	saved, err := ioutil.ReadFile(mpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(mpath, []byte("invalid"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.AddDownload(id); err != nil || n != 51 {
+		t.Errorf("AddDownload with unreadable metadata = %d, %v, want 51", n, err)
+	}
+	if err = ioutil.WriteFile(mpath, saved, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetDisabled(id, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.FlushDownloads(); err != nil {
+		t.Fatal(err)
+	}
+	if meta, _ := s.GetMeta(id); meta.Downloads != 51 || !meta.Disabled {
+		t.Errorf("meta = %+v, want 51 downloads and disabled", meta)
+	}
+
+	s.AddDownload(id)
+	if err = s.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.FlushDownloads(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(s.metaPath(bare)); !os.IsNotExist(err) {
+		t.Error("flushing recreated the metadata of a removed ID")
+	}
+}
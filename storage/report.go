@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reports of an ID are stored as a JSON array in reports/<id>.json until
+// they are dismissed or the ID is removed
+
+type Report struct {
+	Url      string    `json:"url"`
+	Reason   string    `json:"reason"`
+	Reporter string    `json:"reporter"` // an opaque identifier of the reporter
+	Time     time.Time `json:"time"`
+}
+
+// ReportedFile is an ID in the moderation queue
+type ReportedFile struct {
+	Id       string   `json:"id"`
+	Disabled bool     `json:"disabled"`
+	Reports  []Report `json:"reports"`
+}
+
+type ErrDisabled struct{ Id string }
+
+func (e ErrDisabled) Error() string { return "file " + e.Id + " is disabled pending review" }
+
+func (s *Storage) reportPath(id string) string {
+	return path.Join(s.Folder, "reports", id+".json")
+}
+
+func (s *Storage) readReports(id string) (reports []Report, err error) {
+	data, err := ioutil.ReadFile(s.reportPath(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	err = json.Unmarshal(data, &reports)
+	return
+}
+
+// AddReport adds a report about an ID to the moderation queue; it returns
+// the number of distinct reporters of the ID
+func (s *Storage) AddReport(idext string, report Report) (reporters int, err error) {
+	id, _, err := s.splitId(idext)
+	if err != nil {
+		return
+	}
+	_, blob, err := s.lookup(idext)
+	if err != nil {
+		return
+	}
+	if _, err = os.Stat(blob); os.IsNotExist(err) {
+		return 0, ErrNotFound{idext} // removed by Block
+	} else if err != nil {
+		return
+	}
+
+	s.reportLock.Lock()
+	defer s.reportLock.Unlock()
+	reports, err := s.readReports(id)
+	if err != nil {
+		return
+	}
+	reports = append(reports, report)
+	data, err := json.Marshal(reports)
+	if err != nil {
+		return
+	}
+	if err = writeFileAtomic(s.reportPath(id), data); err != nil {
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, r := range reports {
+		seen[r.Reporter] = true
+	}
+	return len(seen), nil
+}
+
+// Reports returns the moderation queue, oldest reports first
+func (s *Storage) Reports() (queue []ReportedFile, err error) {
+	files, err := ioutil.ReadDir(path.Join(s.Folder, "reports"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	s.reportLock.Lock()
+	defer s.reportLock.Unlock()
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		rf := ReportedFile{Id: strings.TrimSuffix(f.Name(), ".json")}
+		if rf.Reports, err = s.readReports(rf.Id); err != nil {
+			return
+		}
+		if len(rf.Reports) == 0 {
+			continue
+		}
+		meta, err := s.GetMeta(rf.Id)
+		if err != nil {
+			return nil, err
+		}
+		rf.Disabled = meta.Disabled
+		queue = append(queue, rf)
+	}
+	sort.Slice(queue, func(i, j int) bool { return queue[i].Reports[0].Time.Before(queue[j].Reports[0].Time) })
+	return
+}
+
+// DismissReports removes the reports of an ID from the moderation queue and
+// enables it again if it was disabled
+func (s *Storage) DismissReports(idext string) error {
+	id, _, err := s.splitId(idext)
+	if err != nil {
+		return err
+	}
+	if err = s.SetDisabled(idext, false); err != nil {
+		if _, ok := err.(ErrNotFound); !ok {
+			return err
+		}
+	}
+	return s.removeReports(id)
+}
+
+func (s *Storage) removeReports(id string) error {
+	s.reportLock.Lock()
+	defer s.reportLock.Unlock()
+	if err := os.Remove(s.reportPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// SetDisabled disables or enables serving an ID
+func (s *Storage) SetDisabled(idext string, disabled bool) error {
+	id, _, err := s.splitId(idext)
+	if err != nil {
+		return err
+	}
+	if _, _, err = s.lookup(idext); err != nil {
+		return err
+	}
+	s.metaLock.Lock()
+	defer s.metaLock.Unlock()
+	meta, err := s.readMeta(id)
+	if err != nil {
+		return err
+	}
+	meta.Disabled = disabled
+	return s.setMeta(id, meta)
+}
+
+func (s *Storage) checkDisabled(idext string) error {
+	meta, err := s.GetMeta(idext)
+	if err != nil {
+		return err
+	}
+	if meta.Disabled {
+		id, _, _ := s.splitId(idext)
+		return ErrDisabled{id}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReports(t *testing.T) {
+	s, _ := newTestStorage(t)
+	id, _, _, _, err := s.New(strings.NewReader("reported"), "a.txt", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, _, _, err := s.New(strings.NewReader("other"), "b.txt", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bare := strings.TrimSuffix(id, ".txt")
+
+	// only distinct reporters are counted towards disabling a file
+	now := time.Now().UTC()
+	for i, test := range []struct {
+		id, reporter string
+		reporters    int
+	}{
+		{id, "alice", 1},
+		{id, "alice", 1},
+		{other, "alice", 1},
+		{id, "bob", 2},
+	} {
+		n, err := s.AddReport(test.id, Report{Reason: "spam", Reporter: test.reporter, Time: now.Add(time.Duration(i) * time.Second)})
+		if err != nil || n != test.reporters {
+			t.Errorf("report %d = %d, %v, want %d reporters", i, n, err, test.reporters)
+		}
+	}
+	if _, err = s.AddReport("zzzzzz", Report{Reporter: "alice"}); err == nil {
+		t.Error("reported a missing ID")
+	}
+	if files, _ := ioutil.ReadDir(path.Join(s.Folder, "reports")); len(files) != 2 {
+		t.Errorf("reports folder has %d files, want 2", len(files))
+	}
+
+	if err = s.SetDisabled(id, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err = s.Get(id); err != (ErrDisabled{bare}) {
+		t.Errorf("Get of a disabled ID: %v", err)
+	}
+	queue, err := s.Reports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queue) != 2 || queue[0].Id != bare || !queue[0].Disabled || len(queue[0].Reports) != 3 || queue[1].Disabled {
+		t.Errorf("queue %+v", queue)
+	}
+
+	if err = s.DismissReports(id); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, s, id); got != "reported" {
+		t.Errorf("dismissed ID contains %q", got)
+	}
+	if queue, err = s.Reports(); err != nil || len(queue) != 1 || queue[0].Id != strings.TrimSuffix(other, ".txt") {
+		t.Errorf("queue after dismissing %+v, %v", queue, err)
+	}
+	// reporters are counted again from the start
+	if n, err := s.AddReport(id, Report{Reporter: "bob"}); err != nil || n != 1 {
+		t.Errorf("report after dismissing = %d, %v, want 1", n, err)
+	}
+}
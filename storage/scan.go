@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const clamdChunkSize = 64 * 1024
+
+type Scanner interface {
+	// Scan returns ErrInfected if r contains malware
+	Scan(r io.Reader) error
+}
+
+type ErrInfected struct{ Signature string }
+
+func (e ErrInfected) Error() string { return "file is infected with " + e.Signature }
+
+type ErrScanFailed struct{ Err error }
+
+func (e ErrScanFailed) Error() string { return "unable to scan file: " + e.Err.Error() }
+
+// ClamdScanner scans files with a clamd-compatible daemon using the INSTREAM
+// command
+type ClamdScanner struct {
+	Network string // "tcp" or "unix"
+	Address string
+	Timeout time.Duration
+}
+
+// NewClamdScanner parses addr as a Unix socket path (optionally prefixed
+// with "unix:") or a TCP host:port (optionally prefixed with "tcp:")
+func NewClamdScanner(addr string, timeout time.Duration) *ClamdScanner {
+	c := &ClamdScanner{Network: "tcp", Address: addr, Timeout: timeout}
+	if strings.HasPrefix(addr, "unix:") {
+		c.Network, c.Address = "unix", addr[len("unix:"):]
+	} else if strings.HasPrefix(addr, "tcp:") {
+		c.Address = addr[len("tcp:"):]
+	} else if strings.HasPrefix(addr, "/") {
+		c.Network = "unix"
+	}
+	return c
+}
+
+func (c *ClamdScanner) Scan(r io.Reader) error {
+	conn, err := net.DialTimeout(c.Network, c.Address, c.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if c.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+
+	if _, err = io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, rerr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err = conn.Write(buf[:4+n]); err != nil {
+				return err
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		} else if rerr != nil {
+			return rerr
+		}
+	}
+	if _, err = conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	// "stream: OK", "stream: <signature> FOUND" or "<message> ERROR"
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return ErrInfected{strings.TrimSuffix(reply, " FOUND")}
+	}
+	return errors.New("clamd: " + reply)
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd speaks the clamd INSTREAM protocol and reports streams that
+// contain "EICAR" as infected
+func fakeClamd(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveClamd(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func serveClamd(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadString(0)
+	if err != nil || cmd != "zINSTREAM\x00" {
+		io.WriteString(conn, "UNKNOWN COMMAND\x00")
+		return
+	}
+	data := []byte{}
+	size := make([]byte, 4)
+	for {
+		if _, err = io.ReadFull(r, size); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint32(size)
+		if n == 0 {
+			break
+		}
+		chunk := make([]byte, n)
+		if _, err = io.ReadFull(r, chunk); err != nil {
+			return
+		}
+		data = append(data, chunk...)
+	}
+	if bytes.Contains(data, []byte("EICAR")) {
+		io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+	} else {
+		io.WriteString(conn, "stream: OK\x00")
+	}
+}
+
+// closedAddr returns an address nothing listens on
+func closedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestScan(t *testing.T) {
+	clamd, closed := fakeClamd(t), closedAddr(t)
+	clean := "hello"
+	infected := strings.Repeat("x", 3*clamdChunkSize) + "EICAR"
+	tests := []struct {
+		name     string
+		addr     string
+		failOpen bool
+		data     string
+		err      error // zero value of the expected error type
+		accepted bool  // accepted because scanning failed
+	}{
+		{"clean", clamd, false, clean, nil, false},
+		{"clean fail-open", clamd, true, clean, nil, false},
+		{"infected", clamd, false, infected, ErrInfected{}, false},
+		{"infected fail-open", clamd, true, infected, ErrInfected{}, false},
+		{"unreachable", closed, false, clean, ErrScanFailed{}, false},
+		{"unreachable fail-open", closed, true, clean, nil, true},
+	}
+	for _, test := range tests {
+		s, _ := newTestStorage(t)
+		s.Scanner = NewClamdScanner("tcp:"+test.addr, time.Second)
+		s.ScanFailOpen = test.failOpen
+		var unscanned []string
+		s.OnScanFailOpen = func(name string, err error) {
+			if _, ok := err.(ErrScanFailed); !ok {
+				t.Errorf("%s: OnScanFailOpen called with %T", test.name, err)
+			}
+			unscanned = append(unscanned, name)
+		}
+
+		id, _, _, _, err := s.New(strings.NewReader(test.data), "a.txt", Options{})
+		switch test.err.(type) {
+		case nil:
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			} else if _, _, _, _, err = s.Get(id); err != nil {
+				t.Errorf("%s: accepted file was not stored: %s", test.name, err)
+			}
+		case ErrInfected:
+			if e, ok := err.(ErrInfected); !ok || e.Signature != "Eicar-Test-Signature" {
+				t.Errorf("%s: err = %v, want ErrInfected", test.name, err)
+			}
+		case ErrScanFailed:
+			if _, ok := err.(ErrScanFailed); !ok {
+				t.Errorf("%s: err = %v, want ErrScanFailed", test.name, err)
+			}
+		}
+		if accepted := len(unscanned) > 0; accepted != test.accepted {
+			t.Errorf("%s: OnScanFailOpen called for %v, want %v", test.name, unscanned, test.accepted)
+		}
+	}
+}
+
+func TestNewClamdScanner(t *testing.T) {
+	tests := []struct {
+		addr, network, address string
+	}{
+		{"127.0.0.1:3310", "tcp", "127.0.0.1:3310"},
+		{"tcp:clamd:3310", "tcp", "clamd:3310"},
+		{"unix:/run/clamd.sock", "unix", "/run/clamd.sock"},
+		{"/run/clamd.sock", "unix", "/run/clamd.sock"},
+	}
+	for _, test := range tests {
+		c := NewClamdScanner(test.addr, time.Second)
+		if c.Network != test.network || c.Address != test.address {
+			t.Errorf("NewClamdScanner(%q) = %s %s, want %s %s", test.addr, c.Network, c.Address, test.network, test.address)
+		}
+	}
+}
@@ -14,6 +14,8 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -33,8 +35,58 @@ type Storage struct {
 	FilterMime []string
 	FilterExt  []string
 	Whitelist  bool
+	Keys       *Keyring
+
+	// files of CompressMime types (prefixes if ending with a slash) of at
+	// least CompressMin bytes are stored compressed; 0 disables compression
+	CompressMin  int64
+	CompressMime []string
+
+	// ThumbSize is the maximum width and height of image thumbnails, which
+	// are generated when first requested; 0 disables thumbnails
+	ThumbSize int
+
+	// Scanner checks uploads for malware; if ScanFailOpen is set, files are
+	// accepted when scanning fails instead of rejected, and OnScanFailOpen is
+	// called, if set, with the name of each such file and the scan error
+	Scanner        Scanner
+	ScanFailOpen   bool
+	OnScanFailOpen func(name string, err error)
+
+	// OnMimeDetect and OnDedup are called, if set, with the time taken to
+	// detect the MIME type of an upload and when an upload was already stored
+	OnMimeDetect func(time.Duration)
+	OnDedup      func()
+
+	blocklist  blocklist
+	reportLock sync.Mutex
+	metaLock   sync.Mutex
+	thumbLock  sync.Mutex // only one thumbnail is generated at a time
+	// blobLock keeps blobs and their encryption markers in sync while blobs
+	// are replaced
+	blobLock sync.RWMutex
+
+	// download counts of IDs that were downloaded since starting
+	downloadLock sync.Mutex
+	downloads    map[string]*downloadCount
 }
 
+type File struct {
+	io.ReadSeeker
+	f    *os.File
+	raw  io.ReadSeeker
+	name string
+	size int64
+}
+
+func (f *File) Name() string { return f.name }
+func (f *File) Size() int64  { return f.size }
+func (f *File) Close() error { return f.f.Close() }
+
+// Gzip returns the gzip-compressed contents of a file stored compressed, or
+// nil if it is stored uncompressed
+func (f *File) Gzip() io.ReadSeeker { return f.raw }
+
 type ErrForbidden struct{ Type string }
 
 func (e ErrForbidden) Error() string { return "forbidden type: " + e.Type }
@@ -59,24 +111,60 @@ func NewStorage(folder string) *Storage {
 	if err := os.MkdirAll(path.Join(folder, "ids"), 0755); err != nil {
 		panic(err)
 	}
+	if err := os.MkdirAll(path.Join(folder, "meta"), 0755); err != nil {
+		panic(err)
+	}
 
 	return &Storage{
 		Folder:    folder,
 		IdCharset: DefaultIdCharset,
 		IdLength:  DefaultIdLength,
 		MaxSize:   DefaultMaxSize,
+
+		CompressMime: DefaultCompressMime,
+	}
+}
+
+// Writable checks that files can be created in the storage folders without
+// writing to the disk
+func (s *Storage) Writable() error {
+	for _, folder := range []string{"temp", "files", "ids", "meta"} {
+		if err := DirWritable(path.Join(s.Folder, folder)); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func (s *Storage) Get(id string) (file *os.File, hash string, size int64, modtime time.Time, err error) {
-	ext := path.Ext(id)
-	id = id[:len(id)-len(ext)]
+// DirWritable checks that files can be created in dir without writing to the
+// disk, so frequent checks are cheap
+func DirWritable(dir string) error {
+	const accessWrite = 0x2 // W_OK, which package syscall does not define
+	if err := syscall.Access(dir, accessWrite); err != nil {
+		return &os.PathError{Op: "access", Path: dir, Err: err}
+	}
+	return nil
+}
+
+func (s *Storage) splitId(idext string) (id, ext string, err error) {
+	ext = path.Ext(idext)
+	id = idext[:len(idext)-len(ext)]
 	for i := 0; i < len(id); i++ {
 		if !strings.ContainsRune(s.IdCharset, rune(id[i])) {
 			err = errors.New("invalid ID: " + id)
 			return
 		}
 	}
+	return
+}
+
+// lookup returns the path of the link named after the original filename and
+// the path of the stored file it points to
+func (s *Storage) lookup(idext string) (link, blob string, err error) {
+	id, ext, err := s.splitId(idext)
+	if err != nil {
+		return
+	}
 	folder := s.idToFolder("ids", id)
 	files, err := ioutil.ReadDir(folder)
 	if err != nil {
@@ -88,18 +176,33 @@ func (s *Storage) Get(id string) (file *os.File, hash string, size int64, modtim
 		return
 	}
 	fn := files[0].Name()
-	fp := path.Join(folder, fn)
-	target, err := os.Readlink(fp)
+	if path.Ext(fn) != ext {
+		err = ErrNotFound{id + ext}
+		return
+	}
+	link = path.Join(folder, fn)
+	target, err := os.Readlink(link)
 	if err != nil {
 		return
 	}
-	bhash, err := base64.RawURLEncoding.DecodeString(path.Base(path.Dir(target)))
+	blob = path.Join(folder, target)
+	return
+}
+
+func (s *Storage) Get(id string) (file *File, hash string, size int64, modtime time.Time, err error) {
+	fp, blob, err := s.lookup(id)
+	if err != nil {
+		return
+	}
+	bhash, err := base64.RawURLEncoding.DecodeString(path.Base(path.Dir(blob)))
 	if err != nil {
 		return
 	}
 	hash = hex.EncodeToString(bhash)
-	if path.Ext(fn) != ext {
-		err = ErrNotFound{id + ext}
+	if err = s.checkBlocked(hash); err != nil {
+		return
+	}
+	if err = s.checkDisabled(id); err != nil {
 		return
 	}
 	stat, err := os.Lstat(fp)
@@ -107,14 +210,201 @@ func (s *Storage) Get(id string) (file *os.File, hash string, size int64, modtim
 		return
 	}
 	modtime = stat.ModTime()
-	size = stat.Size()
-	file, err = os.Open(fp)
+	file, err = s.openBlob(blob, fp)
+	if err != nil {
+		return
+	}
+	size = file.Size()
+	return
+}
+
+// openBlob opens the uploaded file blob at fpath, decrypting and
+// decompressing it as needed
+func (s *Storage) openBlob(fpath, name string) (*File, error) {
+	file, err := s.openDecrypted(fpath, name)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := readGzIndex(path.Join(path.Dir(fpath), gzIndexName))
+	if err == nil {
+		file.raw = file.ReadSeeker
+		file.ReadSeeker = newGzReader(file.raw, idx)
+		file.size = idx.size
+	} else if !os.IsNotExist(err) {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// openDecrypted opens a blob at fpath, decrypting it if needed; unlike
+// openBlob, it ignores the compression index of the folder, which only
+// applies to the uploaded file and not to thumbnails next to it
+func (s *Storage) openDecrypted(fpath, name string) (*File, error) {
+	s.blobLock.RLock()
+	f, err := os.Open(fpath)
+	encrypted := s.isEncrypted(fpath)
+	s.blobLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	file := &File{ReadSeeker: f, f: f, name: name}
+	if encrypted {
+		cr, err := newCryptReader(f, s.Keys)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		file.ReadSeeker = cr
+		file.size = cr.size
+	} else {
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		file.size = stat.Size()
+	}
+	return file, nil
+}
+
+// writeBlob stores the contents of r at fpath, encrypting them if a keyring
+// is set; the file is first written to the temp folder and then renamed
+func (s *Storage) writeBlob(fpath string, r io.Reader) error {
+	return s.replaceBlob(fpath, s.Keys != nil, func(temp *os.File) error {
+		if s.Keys == nil {
+			_, err := io.Copy(temp, r)
+			return err
+		}
+		cw, err := newCryptWriter(temp, s.Keys)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(cw, r); err != nil {
+			return err
+		}
+		return cw.Close()
+	})
+}
+
+// replaceBlob writes a blob to a file in the temp folder with write and
+// renames it to fpath, marking it as encrypted or not
+func (s *Storage) replaceBlob(fpath string, encrypted bool, write func(*os.File) error) error {
+	temp, err := ioutil.TempFile(path.Join(s.Folder, "temp"), "blob")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if temp != nil {
+			temp.Close()
+			os.Remove(temp.Name())
+		}
+	}()
+	if err = write(temp); err == nil {
+		err = temp.Close()
+	}
+	if err != nil {
+		return err
+	}
+	os.Chmod(temp.Name(), 0644)
+
+	// a marker that does not match the blob after a crash makes reading it
+	// fail instead of returning ciphertext as its contents
+	s.blobLock.Lock()
+	defer s.blobLock.Unlock()
+	if encrypted {
+		if err = markEncrypted(fpath); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(temp.Name(), fpath); err != nil {
+		return err
+	}
+	temp = nil
+	if !encrypted {
+		if err = os.Remove(fpath + cryptMarkerExt); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rekey encrypts all stored files with the primary key of the keyring,
+// rewrapping the headers of files encrypted with older keys and encrypting
+// plaintext files; files that fail are passed to onError and skipped
+func (s *Storage) Rekey(onError func(fpath string, err error)) (n int, err error) {
+	if s.Keys == nil {
+		return 0, errors.New("no keyring configured")
+	}
+	err = filepath.Walk(path.Join(s.Folder, "files"), func(fpath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !isBlobFile(info.Name()) {
+			return err
+		}
+		changed, err := s.rekeyBlob(fpath)
+		if err != nil {
+			onError(fpath, err)
+		} else if changed {
+			n++
+		}
+		return nil
+	})
 	return
 }
 
+func (s *Storage) rekeyBlob(fpath string) (changed bool, err error) {
+	s.blobLock.RLock()
+	f, err := os.Open(fpath)
+	encrypted := s.isEncrypted(fpath)
+	s.blobLock.RUnlock()
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if !encrypted {
+		err = s.writeBlob(fpath, f)
+		return err == nil, err
+	}
+	h, err := s.Keys.rewrapHeader(f)
+	if err != nil || h == nil {
+		return false, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return
+	}
+	err = s.replaceBlob(fpath, true, func(temp *os.File) error {
+		if _, err := temp.Write(h); err != nil {
+			return err
+		}
+		_, err := io.Copy(temp, io.NewSectionReader(f, cryptHeaderSize, stat.Size()-cryptHeaderSize))
+		return err
+	})
+	return err == nil, err
+}
+
 var errFileExists = errors.New("file exists")
 
-func (s *Storage) New(r io.Reader, name string) (id, hash string, size int64, err error) {
+type Options struct {
+	// Encrypted marks uploads encrypted by the client; MIME type detection and
+	// scanning are skipped for them, only the extension of their name is
+	// filtered and they are stored with a .bin extension
+	Encrypted bool
+	// StripMetadata removes EXIF, XMP and GPS metadata from images
+	StripMetadata bool
+}
+
+// safeName reduces a client-supplied filename to a single path element, so
+// it cannot escape the ID folder; unusable names are replaced with "file"
+func safeName(name string) string {
+	name = path.Base(name)
+	if name == "." || name == ".." || name == "/" || strings.ContainsAny(name, "/\x00") {
+		return "file"
+	}
+	return name
+}
+
+func (s *Storage) New(r io.Reader, name string, opts Options) (id, hash string, size int64, stripped bool, err error) {
+	name = safeName(name)
 	temp, err := ioutil.TempFile(path.Join(s.Folder, "temp"), "file")
 	if err != nil {
 		return
@@ -130,20 +420,105 @@ func (s *Storage) New(r io.Reader, name string) (id, hash string, size int64, er
 	if err != nil {
 		return
 	}
-	_, _, err = s.getMimeExt(temp.Name(), name)
+	if opts.StripMetadata && !opts.Encrypted {
+		var stemp *os.File
+		if stemp, err = s.stripTemp(temp); err != nil {
+			return
+		} else if stemp != nil {
+			temp.Close()
+			os.Remove(temp.Name())
+			temp = stemp
+			stripped = true
+			if hash, size, err = s.readInput(ioutil.Discard, temp); err != nil {
+				return
+			}
+		}
+	}
+	hexhash, err := base64ToHex(hash)
 	if err != nil {
 		return
 	}
-	id, err = s.storeFile(temp, hash, name)
+	if err = s.checkBlocked(hexhash); err != nil {
+		return
+	}
+	mimetype := ""
+	if opts.Encrypted {
+		if err = s.checkExt(name); err != nil {
+			return
+		}
+		name = strings.TrimSuffix(name, path.Ext(name)) + ".bin"
+	} else {
+		mimetype, _, err = s.getMimeExt(temp.Name(), name)
+		if err != nil {
+			return
+		}
+		if err = s.scan(temp); err != nil {
+			if _, ok := err.(ErrScanFailed); !ok || !s.ScanFailOpen {
+				return
+			}
+			if s.OnScanFailOpen != nil {
+				s.OnScanFailOpen(name, err)
+			}
+			err = nil
+		}
+	}
+	id, err = s.storeFile(temp, hash, name, mimetype, size, Meta{Encrypted: opts.Encrypted, Mime: mimetype})
 	if err == nil {
+		temp.Close()
 		temp = nil // prevent deletion
 	} else if err == errFileExists {
 		err = nil
+		if s.OnDedup != nil {
+			s.OnDedup()
+		}
 	}
 
 	return
 }
 
+func (s *Storage) checkBlocked(hash string) error {
+	blocked, err := s.Blocked(hash)
+	if err == nil && blocked {
+		err = ErrBlocked{hash}
+	}
+	return err
+}
+
+func (s *Storage) scan(file *os.File) error {
+	if s.Scanner == nil {
+		return nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	err := s.Scanner.Scan(file)
+	if _, ok := err.(ErrInfected); ok || err == nil {
+		return err
+	}
+	return ErrScanFailed{err}
+}
+
+// stripTemp returns a new temporary file with the contents of file without
+// metadata, or nil if there was no metadata to strip
+func (s *Storage) stripTemp(file *os.File) (*os.File, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	temp, err := ioutil.TempFile(path.Join(s.Folder, "temp"), "file")
+	if err != nil {
+		return nil, err
+	}
+	// files that cannot be parsed are stored unchanged
+	modified, err := stripMetadata(temp, file)
+	if err != nil || !modified {
+		temp.Close()
+		os.Remove(temp.Name())
+		return nil, nil
+	}
+	_, err = temp.Seek(0, io.SeekStart)
+	return temp, err
+}
+
 func (s *Storage) randomId() string {
 	id := make([]byte, s.IdLength)
 	for i := 0; i < len(id); i++ {
@@ -152,6 +527,20 @@ func (s *Storage) randomId() string {
 	return string(id)
 }
 
+// allocId reserves a random ID in a subfolder by creating its folder,
+// retrying up to MaxIdTries times on collisions
+func (s *Storage) allocId(subfolder string) (id, dir string, err error) {
+	for i := 0; i < MaxIdTries; i++ {
+		id = s.randomId()
+		dir = s.idToFolder(subfolder, id)
+		os.MkdirAll(path.Dir(dir), 0755)
+		if os.Mkdir(dir, 0755) == nil {
+			return
+		}
+	}
+	return "", "", errors.New("internal storage error")
+}
+
 func (s *Storage) idToFolder(subfolder, id string) string {
 	name := id
 	for len(name) < 4 {
@@ -179,7 +568,11 @@ func (s *Storage) readInput(w io.Writer, r io.Reader) (hash string, size int64,
 }
 
 func (s *Storage) getMimeExt(fpath string, name string) (mimetype, ext string, err error) {
+	start := time.Now()
 	mimetype, err = GetMimeType(fpath)
+	if s.OnMimeDetect != nil {
+		s.OnMimeDetect(time.Since(start))
+	}
 	if err != nil {
 		return
 	}
@@ -210,6 +603,20 @@ func (s *Storage) getMimeExt(fpath string, name string) (mimetype, ext string, e
 	return
 }
 
+// checkExt filters a file by the extension of its name only, for files whose
+// contents cannot be inspected
+func (s *Storage) checkExt(name string) error {
+	ext := strings.ToLower(path.Ext(name))
+	filtered := contains(s.FilterExt, ext)
+	if filtered != s.Whitelist {
+		if ext == "" {
+			ext = "no extension"
+		}
+		return ErrForbidden{ext}
+	}
+	return nil
+}
+
 func (s *Storage) findFilter(exts []string, mimetype string) (match string, ok bool) {
 	if contains(s.FilterMime, mimetype) {
 		return mimetype, true
@@ -222,43 +629,32 @@ func (s *Storage) findFilter(exts []string, mimetype string) (match string, ok b
 	return "", false
 }
 
-func (s *Storage) storeFile(file *os.File, hash, name string) (id string, err error) {
+func (s *Storage) storeFile(file *os.File, hash, name, mimetype string, size int64, meta Meta) (id string, err error) {
 	hfolder := s.idToFolder("files", hash)
 	hpath := path.Join(hfolder, "file")
 	fexists := false
 	ext := path.Ext(name)
 
 	os.MkdirAll(path.Dir(hfolder), 0755)
-	err = os.Mkdir(hfolder, 0755)
-	if err != nil {
-		if _, err = os.Stat(hpath); err != nil {
-			err = errors.New("internal storage error")
-		}
+	if _, err = os.Stat(hpath); err == nil {
 		fexists = true
-	} else {
-		err = os.Rename(file.Name(), hpath)
-		os.Chmod(hpath, 0644)
+	} else if err = s.storeFolder(file, hfolder, mimetype, size); err != nil {
+		// a concurrent upload of the same file may have stored it first
+		if _, serr := os.Stat(hpath); serr != nil {
+			return
+		}
+		fexists, err = true, nil
 	}
+
+	id, dir, err := s.allocId("ids")
 	if err != nil {
 		return
 	}
-
-	fpath := ""
-	for i := 0; i < MaxIdTries; i++ {
-		id = s.randomId()
-		dir := s.idToFolder("ids", id)
-		os.MkdirAll(path.Dir(dir), 0755)
-		err = os.Mkdir(dir, 0755)
-		if err == nil {
-			fpath = path.Join(dir, name)
-			id += ext
-			break
-		}
-	}
-	if fpath == "" {
-		err = errors.New("internal storage error")
+	fpath := path.Join(dir, name)
+	if err = s.setMeta(id, meta); err != nil {
 		return
 	}
+	id += ext
 	rhpath, err := filepath.Rel(path.Dir(fpath), hpath)
 	if err != nil {
 		return
@@ -271,6 +667,55 @@ func (s *Storage) storeFile(file *os.File, hash, name string) (id string, err er
 	return
 }
 
+// storeFolder builds the folder of a stored file with its blob and the
+// files next to it in the temp folder and renames it into place at hfolder,
+// so no folder without a blob is visible if storing it fails or takes long
+func (s *Storage) storeFolder(file *os.File, hfolder, mimetype string, size int64) error {
+	tfolder, err := ioutil.TempDir(path.Join(s.Folder, "temp"), "folder")
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(tfolder, 0755); err == nil {
+		err = s.storeBlob(file, tfolder, mimetype, size)
+	}
+	if err == nil {
+		err = os.Rename(tfolder, hfolder)
+		// an empty folder left behind by older versions is replaced; Remove
+		// fails if the folder was stored by a concurrent upload
+		if err != nil && os.Remove(hfolder) == nil {
+			err = os.Rename(tfolder, hfolder)
+		}
+	}
+	if err != nil {
+		os.RemoveAll(tfolder)
+	}
+	return err
+}
+
+func (s *Storage) storeBlob(file *os.File, hfolder, mimetype string, size int64) error {
+	hpath := path.Join(hfolder, "file")
+	if s.compressible(mimetype, size) {
+		ok, err := s.compressBlob(file, hfolder, size)
+		if err != nil {
+			return err
+		} else if ok {
+			return os.Remove(file.Name())
+		}
+	}
+	if s.Keys != nil {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := s.writeBlob(hpath, file); err != nil {
+			return err
+		}
+		return os.Remove(file.Name())
+	}
+	err := os.Rename(file.Name(), hpath)
+	os.Chmod(hpath, 0644)
+	return err
+}
+
 func contains(ss []string, search string) bool {
 	for _, s := range ss {
 		if s == search {
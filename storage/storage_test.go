@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestStorage(t *testing.T) (*Storage, string) {
+	dir, err := ioutil.TempDir("", "gomf-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return NewStorage(path.Join(dir, "upload")), dir
+}
+
+func TestSafeName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"file.txt", "file.txt"},
+		{"../../../../../static/evil.html", "evil.html"},
+		{"dir/sub/name.png", "name.png"},
+		{"..", "file"},
+		{".", "file"},
+		{"", "file"},
+		{"/", "file"},
+		{"a/..", "file"},
+		{"nul\x00.txt", "file"},
+	}
+	for _, test := range tests {
+		if got := safeName(test.name); got != test.want {
+			t.Errorf("safeName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNewPathTraversal(t *testing.T) {
+	s, dir := newTestStorage(t)
+	for _, name := range []string{"../../../../../static/evil.html", "..", "../..", "a/../../b.txt"} {
+		id, _, _, _, err := s.New(strings.NewReader("<script>alert(1)</script>"), name, Options{})
+		if err != nil {
+			t.Fatalf("New(%q): %s", name, err)
+		}
+		f, _, _, _, err := s.Get(id)
+		if err != nil {
+			t.Fatalf("Get(%q) for %q: %s", id, name, err)
+		}
+		link := f.Name()
+		f.Close()
+		if path.Dir(path.Dir(link)) != path.Dir(s.idToFolder("ids", strings.TrimSuffix(id, path.Ext(id)))) {
+			t.Errorf("%q was stored outside its ID folder: %s", name, link)
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range files {
+		if fi.Name() != "upload" {
+			t.Errorf("unexpected file %s created outside the storage folder", fi.Name())
+		}
+	}
+	if _, err := os.Lstat(path.Join(s.Folder, "static")); !os.IsNotExist(err) {
+		t.Errorf("static/ was created in the storage folder")
+	}
+}
+
+func TestNewEncryptedFilter(t *testing.T) {
+	s, _ := newTestStorage(t)
+	s.FilterExt = []string{".exe", ".dll"}
+	tests := []struct {
+		name    string
+		allowed bool
+		ext     string
+	}{
+		{"encrypted.bin", true, ".bin"},
+		{"photo.png", true, ".bin"},
+		{"a.exe", false, ""},
+		{"A.EXE", false, ""},
+		{"lib.dll", false, ""},
+		{"noext", true, ".bin"},
+	}
+	for _, test := range tests {
+		id, _, _, _, err := s.New(strings.NewReader("MZ\x90\x00 ciphertext of "+test.name), test.name, Options{Encrypted: true})
+		if !test.allowed {
+			if _, ok := err.(ErrForbidden); !ok {
+				t.Errorf("encrypted %q: got %v, want ErrForbidden", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("encrypted %q: %s", test.name, err)
+			continue
+		}
+		if ext := path.Ext(id); ext != test.ext {
+			t.Errorf("encrypted %q stored as %q, want extension %q", test.name, id, test.ext)
+		}
+	}
+
+	s.Whitelist = true
+	s.FilterExt = []string{".bin"}
+	if _, _, _, _, err := s.New(strings.NewReader("x"), "a.exe", Options{Encrypted: true}); err == nil {
+		t.Errorf("encrypted a.exe accepted with a whitelist without .exe")
+	}
+	if _, _, _, _, err := s.New(strings.NewReader("y"), "a.bin", Options{Encrypted: true}); err != nil {
+		t.Errorf("encrypted a.bin rejected with a whitelist containing .bin: %s", err)
+	}
+}
+
+func TestNewConcurrentSameFile(t *testing.T) {
+	s, _ := newTestStorage(t)
+	// compression and encryption make storing the blob take longer
+	s.Keys = testKeyring(t, 1)
+	s.CompressMin = 1
+	s.CompressMime = []string{"text/"}
+	content := strings.Repeat("the same file uploaded at once\n", 50000)
+
+	const n = 8
+	ids := make([]string, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], _, _, _, errs[i] = s.New(strings.NewReader(content), "same.txt", Options{})
+		}(i)
+	}
+	wg.Wait()
+	for i := range ids {
+		if errs[i] != nil {
+			t.Errorf("upload %d: %s", i, errs[i])
+		} else if readAll(t, s, ids[i]) != content {
+			t.Errorf("upload %d: %s has different contents", i, ids[i])
+		}
+	}
+	if files, _ := ioutil.ReadDir(path.Join(s.Folder, "temp")); len(files) != 0 {
+		t.Errorf("%d files left in the temp folder", len(files))
+	}
+}
+
+func TestNewEmptyHashFolder(t *testing.T) {
+	s, _ := newTestStorage(t)
+	content := "uploaded after a failed upload"
+	sum := sha1.Sum([]byte(content))
+	// left behind by a failed upload of the same file
+	hfolder := s.idToFolder("files", base64.RawURLEncoding.EncodeToString(sum[:]))
+	if err := os.MkdirAll(hfolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	id, _, _, _, err := s.New(strings.NewReader(content), "a.txt", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, s, id); got != content {
+		t.Errorf("got %q, want %q", got, content)
+	}
+}
@@ -0,0 +1,325 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// metadata stripping removes EXIF (including GPS), XMP and similar metadata
+// from JPEG, PNG and WebP images; the EXIF orientation is kept in a minimal
+// EXIF block so the image is still displayed the right way up
+
+var errBadImage = errors.New("malformed image")
+
+var (
+	jpegExif = []byte("Exif\x00\x00")
+	jpegXmp  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	jpegXmpx = []byte("http://ns.adobe.com/xmp/extension/\x00")
+	pngSig   = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// stripMetadata copies src to dst without metadata; it returns false and
+// leaves dst in an undefined state if src is not a supported image or has no
+// metadata to remove
+func stripMetadata(dst *os.File, src io.Reader) (bool, error) {
+	br := bufio.NewReader(src)
+	magic, _ := br.Peek(12)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0xff, 0xd8, 0xff}):
+		return stripJpeg(dst, br)
+	case bytes.HasPrefix(magic, pngSig):
+		return stripPng(dst, br)
+	case len(magic) == 12 && string(magic[0:4]) == "RIFF" && string(magic[8:12]) == "WEBP":
+		return stripWebp(dst, br)
+	}
+	return false, nil
+}
+
+// exifOrientation returns the orientation tag of TIFF-structured EXIF data,
+// or 0 if there is none
+func exifOrientation(tiff []byte) uint16 {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var bo binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(bo.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	n := int(bo.Uint16(tiff[ifd:]))
+	for i := 0; i < n; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(tiff) {
+			return 0
+		}
+		if bo.Uint16(tiff[e:]) == 0x0112 && bo.Uint16(tiff[e+2:]) == 3 {
+			return bo.Uint16(tiff[e+8:])
+		}
+	}
+	return 0
+}
+
+// maxExifSize bounds how much of a PNG or WebP EXIF chunk is read to find the
+// orientation; it is the largest EXIF block a JPEG can hold
+const maxExifSize = 0xffff
+
+// readExif reads the first maxExifSize bytes of an n byte chunk and discards
+// the rest, so the chunk length read from the file does not decide how much
+// is allocated
+func readExif(r *bufio.Reader, n int64) ([]byte, error) {
+	m := n
+	if m > maxExifSize {
+		m = maxExifSize
+	}
+	data := make([]byte, m)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	_, err := io.CopyN(ioutil.Discard, r, n-m)
+	return data, err
+}
+
+// orientationExif builds TIFF-structured EXIF data containing only the
+// orientation tag
+func orientationExif(orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+	binary.BigEndian.PutUint16(tiff[18:], orientation)
+	return tiff
+}
+
+func stripJpeg(w io.Writer, r *bufio.Reader) (modified bool, err error) {
+	soi := make([]byte, 2)
+	if _, err = io.ReadFull(r, soi); err != nil {
+		return
+	}
+	if _, err = w.Write(soi); err != nil {
+		return
+	}
+	for {
+		var marker byte
+		if marker, err = r.ReadByte(); err != nil {
+			return
+		}
+		if marker != 0xff {
+			return false, errBadImage
+		}
+		for marker == 0xff { // fill bytes
+			if marker, err = r.ReadByte(); err != nil {
+				return
+			}
+		}
+		if marker == 0xd9 || marker == 0xda || (marker >= 0xd0 && marker <= 0xd7) || marker == 0x01 {
+			// EOI, SOS or standalone marker: copy the rest verbatim
+			if _, err = w.Write([]byte{0xff, marker}); err != nil {
+				return
+			}
+			_, err = io.Copy(w, r)
+			return
+		}
+
+		lenb := make([]byte, 2)
+		if _, err = io.ReadFull(r, lenb); err != nil {
+			return
+		}
+		n := int(binary.BigEndian.Uint16(lenb))
+		if n < 2 {
+			return false, errBadImage
+		}
+		data := make([]byte, n-2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return
+		}
+
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(data, jpegExif):
+			o := exifOrientation(data[len(jpegExif):])
+			if o <= 1 {
+				modified = true
+				continue
+			}
+			exif := append(append([]byte{}, jpegExif...), orientationExif(o)...)
+			modified = modified || !bytes.Equal(exif, data)
+			data = exif
+		case marker == 0xe1 && (bytes.HasPrefix(data, jpegXmp) || bytes.HasPrefix(data, jpegXmpx)):
+			modified = true
+			continue
+		case marker == 0xed: // Photoshop IRB, which contains IPTC
+			modified = true
+			continue
+		}
+		binary.BigEndian.PutUint16(lenb, uint16(len(data)+2))
+		if _, err = w.Write([]byte{0xff, marker}); err != nil {
+			return
+		}
+		if _, err = w.Write(lenb); err != nil {
+			return
+		}
+		if _, err = w.Write(data); err != nil {
+			return
+		}
+	}
+}
+
+func writePngChunk(w io.Writer, typ string, data []byte) error {
+	buf := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], typ)
+	buf = append(buf, data...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(buf[4:]))
+	_, err := w.Write(append(buf, crc...))
+	return err
+}
+
+func stripPng(w io.Writer, r *bufio.Reader) (modified bool, err error) {
+	sig := make([]byte, len(pngSig))
+	if _, err = io.ReadFull(r, sig); err != nil {
+		return
+	}
+	if _, err = w.Write(sig); err != nil {
+		return
+	}
+	head := make([]byte, 8)
+	for {
+		if _, err = io.ReadFull(r, head); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		n := int64(binary.BigEndian.Uint32(head))
+		typ := string(head[4:])
+		switch typ {
+		case "eXIf":
+			var data []byte
+			if data, err = readExif(r, n); err != nil {
+				return
+			}
+			if _, err = r.Discard(4); err != nil {
+				return
+			}
+			exif := []byte(nil)
+			if o := exifOrientation(data); o > 1 {
+				exif = orientationExif(o)
+				if err = writePngChunk(w, typ, exif); err != nil {
+					return
+				}
+			}
+			modified = modified || !bytes.Equal(exif, data)
+		case "tEXt", "zTXt", "iTXt":
+			modified = true
+			if _, err = r.Discard(int(n) + 4); err != nil {
+				return
+			}
+		default:
+			if _, err = w.Write(head); err != nil {
+				return
+			}
+			if _, err = io.CopyN(w, r, n+4); err != nil {
+				return
+			}
+			if typ == "IEND" {
+				return
+			}
+		}
+	}
+}
+
+func stripWebp(w *os.File, r *bufio.Reader) (modified bool, err error) {
+	head := make([]byte, 12)
+	if _, err = io.ReadFull(r, head); err != nil {
+		return
+	}
+	if _, err = w.Write(head); err != nil {
+		return
+	}
+	size := int64(4)
+	exif := []byte(nil)
+	flagsAt := int64(-1)
+	for {
+		if _, err = io.ReadFull(r, head[:8]); err != nil {
+			if err == io.EOF {
+				err = nil
+				break
+			}
+			return
+		}
+		typ := string(head[:4])
+		n := int64(binary.LittleEndian.Uint32(head[4:8]))
+		padded := n + n&1
+		switch typ {
+		case "EXIF":
+			modified = true
+			var data []byte
+			if data, err = readExif(r, n); err != nil {
+				return
+			}
+			if _, err = r.Discard(int(padded - n)); err != nil {
+				return
+			}
+			if o := exifOrientation(bytes.TrimPrefix(data, jpegExif)); o > 1 {
+				exif = orientationExif(o)
+			}
+			continue
+		case "XMP ":
+			modified = true
+			if _, err = r.Discard(int(padded)); err != nil {
+				return
+			}
+			continue
+		case "VP8X":
+			flagsAt = 12 + size - 4 + 8
+		}
+		if _, err = w.Write(head[:8]); err != nil {
+			return
+		}
+		if _, err = io.CopyN(w, r, padded); err != nil {
+			return
+		}
+		size += 8 + padded
+	}
+	if !modified {
+		return
+	}
+
+	if exif != nil {
+		chunk := make([]byte, 8, 8+len(exif))
+		copy(chunk, "EXIF")
+		binary.LittleEndian.PutUint32(chunk[4:], uint32(len(exif)))
+		if _, err = w.Write(append(chunk, exif...)); err != nil {
+			return
+		}
+		size += int64(len(chunk) + len(exif))
+	}
+	if flagsAt >= 0 {
+		flags := make([]byte, 1)
+		if _, err = w.ReadAt(flags, flagsAt); err != nil {
+			return
+		}
+		flags[0] &^= 0x08 | 0x04 // EXIF, XMP
+		if exif != nil {
+			flags[0] |= 0x08
+		}
+		if _, err = w.WriteAt(flags, flagsAt); err != nil {
+			return
+		}
+	}
+	sizeb := make([]byte, 4)
+	binary.LittleEndian.PutUint32(sizeb, uint32(size))
+	_, err = w.WriteAt(sizeb, 4)
+	return
+}
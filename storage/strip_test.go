@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// testExif returns TIFF-structured EXIF data with an orientation and a GPS
+// IFD pointer tag
+func testExif(orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x02" +
+		"\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00" +
+		"\x88\x25\x00\x04\x00\x00\x00\x01\x00\x00\x00\x00" +
+		"\x00\x00\x00\x00")
+	binary.BigEndian.PutUint16(tiff[18:], orientation)
+	return tiff
+}
+
+func testJpeg(t *testing.T, exif []byte) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := append(append([]byte{}, jpegExif...), exif...)
+	seg := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(data)+2))
+	img := buf.Bytes()
+	return append(append(append(append([]byte{}, img[:2]...), seg...), data...), img[2:]...)
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	var buf bytes.Buffer
+	if err := writePngChunk(&buf, typ, data); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func testPng(t *testing.T, chunks ...[]byte) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	img := buf.Bytes()
+	ihdr := len(pngSig) + 12 + 13
+	out := append([]byte{}, img[:ihdr]...)
+	for _, c := range chunks {
+		out = append(out, c...)
+	}
+	return append(out, img[ihdr:]...)
+}
+
+func webpChunk(typ string, data []byte) []byte {
+	c := make([]byte, 8, 8+len(data)+1)
+	copy(c, typ)
+	binary.LittleEndian.PutUint32(c[4:], uint32(len(data)))
+	c = append(c, data...)
+	if len(data)%2 == 1 {
+		c = append(c, 0)
+	}
+	return c
+}
+
+func testWebp(chunks ...[]byte) []byte {
+	body := []byte("WEBP")
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	out := []byte("RIFF\x00\x00\x00\x00")
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(body)))
+	return append(out, body...)
+}
+
+func strip(t *testing.T, src []byte) ([]byte, bool, error) {
+	f, err := ioutil.TempFile("", "gomf-strip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	modified, err := stripMetadata(f, bytes.NewReader(src))
+	if err != nil || !modified {
+		return nil, modified, err
+	}
+	if _, err = f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out, true, nil
+}
+
+func TestStripMetadata(t *testing.T) {
+	vp8x := webpChunk("VP8X", []byte{0x08 | 0x04, 0, 0, 0, 7, 0, 0, 7, 0, 0})
+	tests := []struct {
+		name        string
+		src         []byte
+		modified    bool
+		orientation uint16
+		decode      bool
+	}{
+		{"jpeg", testJpeg(t, testExif(6)), true, 6, true},
+		{"jpeg without orientation", testJpeg(t, testExif(1)), true, 0, true},
+		{"jpeg stripped", testJpeg(t, orientationExif(3)), false, 3, true},
+		{"png", testPng(t, pngChunk("eXIf", testExif(8)), pngChunk("tEXt", []byte("GPS\x00here"))), true, 8, true},
+		{"png text", testPng(t, pngChunk("tEXt", []byte("Author\x00me"))), true, 0, true},
+		{"png clean", testPng(t), false, 0, true},
+		{"webp", testWebp(vp8x, webpChunk("VP8L", []byte("x")), webpChunk("EXIF", testExif(6)), webpChunk("XMP ", []byte("<x/>"))), true, 6, false},
+		{"webp clean", testWebp(webpChunk("VP8L", []byte("x"))), false, 0, false},
+		{"text", []byte("not an image"), false, 0, false},
+	}
+	for _, test := range tests {
+		out, modified, err := strip(t, test.src)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if modified != test.modified {
+			t.Errorf("%s: modified = %v, want %v", test.name, modified, test.modified)
+		}
+		if !modified {
+			continue
+		}
+		if bytes.Contains(out, []byte{0x88, 0x25}) || bytes.Contains(out, []byte("GPS")) || bytes.Contains(out, []byte("XMP")) {
+			t.Errorf("%s: metadata was not removed", test.name)
+		}
+		var o uint16
+		if i := bytes.Index(out, []byte("MM\x00\x2a")); i >= 0 {
+			o = exifOrientation(out[i:])
+		}
+		if o != test.orientation {
+			t.Errorf("%s: orientation = %d, want %d", test.name, o, test.orientation)
+		}
+		if test.decode {
+			if _, _, err = image.Decode(bytes.NewReader(out)); err != nil {
+				t.Errorf("%s: stripped image does not decode: %s", test.name, err)
+			}
+		}
+		if test.name == "webp" {
+			if size := binary.LittleEndian.Uint32(out[4:]); int(size) != len(out)-8 {
+				t.Errorf("webp: RIFF size = %d, want %d", size, len(out)-8)
+			}
+			if flags := out[20]; flags&0x04 != 0 || flags&0x08 == 0 {
+				t.Errorf("webp: VP8X flags = %#x", flags)
+			}
+		}
+	}
+}
+
+// a chunk length is read from the file and must not decide how much memory
+// is allocated
+func TestStripHugeChunk(t *testing.T) {
+	pngHead := append(append([]byte{}, pngSig...), 0xff, 0xff, 0xff, 0xf0)
+	tests := map[string][]byte{
+		"png":  append(append(pngHead, "eXIfMM"...), pngChunk("IEND", nil)...),
+		"webp": append([]byte("RIFF\x00\x00\x00\x00WEBPEXIF\xf0\xff\xff\xff"), "MM\x00\x2a"...),
+	}
+	for name, src := range tests {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		_, _, err := strip(t, src)
+		runtime.ReadMemStats(&after)
+		if err == nil {
+			t.Errorf("%s: truncated chunk was accepted", name)
+		}
+		if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+			t.Errorf("%s: allocated %d bytes for a %d byte file", name, n, len(src))
+		}
+	}
+}
+
+func TestNewStripMetadata(t *testing.T) {
+	s, _ := newTestStorage(t)
+	src := testJpeg(t, testExif(6))
+	id, _, size, stripped, err := s.New(bytes.NewReader(src), "photo.jpg", Options{StripMetadata: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stripped || size >= int64(len(src)) {
+		t.Errorf("stripped = %v, size = %d of %d", stripped, size, len(src))
+	}
+	if data := readAll(t, s, id); strings.Contains(data, "\x88\x25") {
+		t.Error("stored file still contains GPS metadata")
+	}
+}
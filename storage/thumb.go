@@ -0,0 +1,352 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"time"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	thumbJpeg = "thumb.jpg"
+	thumbPng  = "thumb.png"
+	thumbNone = "thumb.none" // marks files that cannot be thumbnailed
+
+	// images larger than this are not decoded to avoid decompression bombs
+	// and to bound the memory used by generating a thumbnail
+	maxThumbPixels = 24 * 1000 * 1000
+)
+
+var thumbMime = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+var ErrNoThumbnail = errors.New("no thumbnail available")
+
+func isBlobFile(name string) bool {
+	return name == "file" || name == thumbJpeg || name == thumbPng
+}
+
+// Thumbnail returns a thumbnail of an uploaded image, generating and caching
+// it next to the stored file when it is first requested
+func (s *Storage) Thumbnail(idext string) (file *File, modtime time.Time, err error) {
+	hfolder, err := s.thumbnailFolder(idext)
+	if err != nil {
+		return
+	}
+	hash, err := base64ToHex(path.Base(hfolder))
+	if err != nil {
+		return
+	}
+	if err = s.checkBlocked(hash); err != nil {
+		return
+	}
+	tpath := s.findThumbnail(hfolder)
+	if tpath == "" {
+		s.thumbLock.Lock()
+		// another request may have generated it in the meantime
+		if tpath = s.findThumbnail(hfolder); tpath == "" {
+			tpath, err = s.makeThumbnail(hfolder)
+		}
+		s.thumbLock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+	if path.Base(tpath) == thumbNone {
+		err = ErrNoThumbnail
+		return
+	}
+	stat, err := os.Stat(tpath)
+	if err != nil {
+		return
+	}
+	modtime = stat.ModTime()
+	file, err = s.openDecrypted(tpath, tpath)
+	return
+}
+
+// HasThumbnail reports whether a thumbnail of an uploaded file can be
+// requested; it does not generate the thumbnail
+func (s *Storage) HasThumbnail(idext string) bool {
+	_, err := s.thumbnailFolder(idext)
+	return err == nil
+}
+
+// thumbnailFolder returns the folder of the stored file of an ID if the file
+// is an image that can have a thumbnail
+func (s *Storage) thumbnailFolder(idext string) (string, error) {
+	if s.ThumbSize <= 0 {
+		return "", ErrNoThumbnail
+	}
+	id, ext, err := s.splitId(idext)
+	if err != nil {
+		return "", err
+	}
+	meta, err := s.readMeta(id)
+	if err != nil || meta.Encrypted {
+		return "", ErrNoThumbnail
+	} else if meta.Disabled {
+		return "", ErrDisabled{idext}
+	}
+	mimetype := meta.Mime
+	if mimetype == "" {
+		// stored before the type was kept in the metadata; the extension
+		// of an ID is chosen by its detected type
+		mimetype, _, _ = mime.ParseMediaType(mime.TypeByExtension(ext))
+	}
+	if !contains(thumbMime, mimetype) {
+		return "", ErrNoThumbnail
+	}
+	_, blob, err := s.lookup(idext)
+	if err != nil {
+		return "", err
+	}
+	hfolder := path.Dir(blob)
+	if _, err = os.Stat(path.Join(hfolder, thumbNone)); err == nil {
+		return "", ErrNoThumbnail
+	}
+	return hfolder, nil
+}
+
+func (s *Storage) findThumbnail(hfolder string) string {
+	for _, name := range []string{thumbJpeg, thumbPng, thumbNone} {
+		if _, err := os.Stat(path.Join(hfolder, name)); err == nil {
+			return path.Join(hfolder, name)
+		}
+	}
+	return ""
+}
+
+// readErrors remembers the errors of reading a file, so they can be told
+// apart from errors decoding it
+type readErrors struct {
+	io.ReadSeeker
+	err error
+}
+
+func (r *readErrors) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// makeThumbnail generates the thumbnail of the stored file in hfolder; files
+// in unsupported formats, that cannot be decoded or are too large are marked
+// as having none, but errors reading the file are only returned
+func (s *Storage) makeThumbnail(hfolder string) (string, error) {
+	f, err := s.openBlob(path.Join(hfolder, "file"), "")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	r := &readErrors{ReadSeeker: f}
+
+	cfg, format, err := image.DecodeConfig(r)
+	if r.err != nil {
+		return "", r.err
+	} else if err != nil || cfg.Width*cfg.Height > maxThumbPixels {
+		return s.noThumbnail(hfolder)
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	img, _, err := image.Decode(r)
+	if r.err != nil {
+		return "", r.err
+	} else if err != nil {
+		return s.noThumbnail(hfolder)
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	orientation := imageOrientation(r, format)
+	if r.err != nil {
+		return "", r.err
+	}
+
+	thumb := orient(scaleDown(img, s.ThumbSize), orientation)
+	buf := &bytes.Buffer{}
+	tpath := path.Join(hfolder, thumbPng)
+	if format == "jpeg" {
+		tpath = path.Join(hfolder, thumbJpeg)
+		err = jpeg.Encode(buf, thumb, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(buf, thumb)
+	}
+	if err != nil {
+		return "", err
+	}
+	return tpath, s.writeBlob(tpath, buf)
+}
+
+func (s *Storage) noThumbnail(hfolder string) (string, error) {
+	tpath := path.Join(hfolder, thumbNone)
+	f, err := os.Create(tpath)
+	if err != nil {
+		return "", err
+	}
+	return tpath, f.Close()
+}
+
+// imageOrientation returns the EXIF orientation of an image in the given
+// format, or 0 if it has none
+func imageOrientation(r io.Reader, format string) uint16 {
+	br := bufio.NewReader(r)
+	head := make([]byte, 8)
+	switch format {
+	case "jpeg":
+		if _, err := br.Discard(2); err != nil {
+			return 0
+		}
+		for {
+			if _, err := io.ReadFull(br, head[:2]); err != nil || head[0] != 0xff {
+				return 0
+			}
+			marker := head[1]
+			for marker == 0xff { // fill bytes
+				var err error
+				if marker, err = br.ReadByte(); err != nil {
+					return 0
+				}
+			}
+			if marker == 0xd9 || marker == 0xda {
+				return 0 // EOI or SOS: no EXIF before the image data
+			} else if (marker >= 0xd0 && marker <= 0xd7) || marker == 0x01 {
+				continue
+			}
+			if _, err := io.ReadFull(br, head[:2]); err != nil {
+				return 0
+			}
+			n := int(binary.BigEndian.Uint16(head)) - 2
+			if n < 0 {
+				return 0
+			}
+			if marker != 0xe1 {
+				if _, err := br.Discard(n); err != nil {
+					return 0
+				}
+				continue
+			}
+			data := make([]byte, n)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return 0
+			}
+			if bytes.HasPrefix(data, jpegExif) {
+				return exifOrientation(data[len(jpegExif):])
+			}
+		}
+	case "png":
+		if _, err := br.Discard(len(pngSig)); err != nil {
+			return 0
+		}
+		for {
+			if _, err := io.ReadFull(br, head); err != nil {
+				return 0
+			}
+			n := int64(binary.BigEndian.Uint32(head))
+			switch string(head[4:]) {
+			case "eXIf":
+				data, _ := readExif(br, n)
+				return exifOrientation(data)
+			case "IDAT", "IEND":
+				return 0
+			}
+			if _, err := br.Discard(int(n) + 4); err != nil {
+				return 0
+			}
+		}
+	case "webp":
+		if _, err := br.Discard(12); err != nil {
+			return 0
+		}
+		for {
+			if _, err := io.ReadFull(br, head); err != nil {
+				return 0
+			}
+			n := int64(binary.LittleEndian.Uint32(head[4:]))
+			if string(head[:4]) == "EXIF" {
+				data, _ := readExif(br, n)
+				return exifOrientation(bytes.TrimPrefix(data, jpegExif))
+			}
+			if _, err := br.Discard(int(n + n&1)); err != nil {
+				return 0
+			}
+		}
+	}
+	return 0
+}
+
+// orient transforms an image as described by an EXIF orientation so it is
+// the right way up
+func orient(img *image.RGBA, orientation uint16) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if orientation >= 5 {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // rotated 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise to display
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90° counterclockwise to display
+				dx, dy = y, w-1-x
+			}
+			si, di := img.PixOffset(b.Min.X+x, b.Min.Y+y), dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], img.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// scaleDown shrinks img to fit in a max by max square
+func scaleDown(img image.Image, max int) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tw, th := w, h
+	if w > max || h > max {
+		if w > h {
+			tw, th = max, h*max/w
+		} else {
+			tw, th = w*max/h, max
+		}
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, tw, th))
+	xdraw.BiLinear.Scale(thumb, thumb.Bounds(), img, b, xdraw.Src, nil)
+	return thumb
+}
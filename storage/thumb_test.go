@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+func TestThumbnail(t *testing.T) {
+	// an uncompressed PNG is stored gzip-compressed
+	img := image.NewGray(image.Rect(0, 0, 64, 48))
+	var pngData bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.NoCompression}
+	if err := enc.Encode(&pngData, img); err != nil {
+		t.Fatal(err)
+	}
+	webpData, err := ioutil.ReadFile("testdata/gopher.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ := newTestStorage(t)
+	s.ThumbSize = 16
+	// compressed source blobs must not affect how thumbnails are read
+	s.CompressMin = 1
+	s.CompressMime = []string{"image/png"}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"plain.png", pngData.Bytes()},
+		{"gopher.webp", webpData},
+	}
+	for _, test := range tests {
+		id, _, _, _, err := s.New(bytes.NewReader(test.data), test.name, Options{})
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !s.HasThumbnail(id) {
+			t.Errorf("%s: no thumbnail", test.name)
+			continue
+		}
+		f, _, err := s.Thumbnail(id)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		img, format, err := image.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: thumbnail does not decode: %s", test.name, err)
+			continue
+		}
+		if b := img.Bounds(); format != "png" || b.Dx() > 16 || b.Dy() > 16 {
+			t.Errorf("%s: thumbnail is a %dx%d %s", test.name, b.Dx(), b.Dy(), format)
+		}
+	}
+}
+
+func TestThumbnailLazy(t *testing.T) {
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, image.NewGray(image.Rect(0, 0, 64, 48))); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newTestStorage(t)
+	id, _, _, _, err := s.New(bytes.NewReader(pngData.Bytes()), "a.png", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	textId, _, _, _, err := s.New(bytes.NewReader([]byte("not an image")), "a.txt", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.HasThumbnail(id) {
+		t.Error("HasThumbnail without ThumbSize")
+	}
+	if _, _, err = s.Thumbnail(id); err != ErrNoThumbnail {
+		t.Errorf("Thumbnail without ThumbSize: %v", err)
+	}
+
+	s.ThumbSize = 16
+	_, blob, _ := s.lookup(id)
+	if tpath := s.findThumbnail(path.Dir(blob)); tpath != "" {
+		t.Errorf("thumbnail %s generated before it was requested", tpath)
+	}
+	if !s.HasThumbnail(id) || s.HasThumbnail(textId) {
+		t.Errorf("HasThumbnail = %v for an image, %v for text", s.HasThumbnail(id), s.HasThumbnail(textId))
+	}
+	f, _, err := s.Thumbnail(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if _, _, err = s.Thumbnail(textId); err != ErrNoThumbnail {
+		t.Errorf("Thumbnail of text: %v", err)
+	}
+}
+
+func TestThumbnailErrors(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 256, 256))
+	var pngData bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.NoCompression}
+	if err := enc.Encode(&pngData, img); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := newTestStorage(t)
+	s.ThumbSize = 16
+	s.CompressMin = 1
+	s.CompressMime = []string{"image/png"}
+
+	// a truncated image cannot be decoded and never will be
+	truncated := pngData.Bytes()[:len(pngSig)+25+100]
+	id, _, _, _, err := s.New(bytes.NewReader(truncated), "truncated.png", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = s.Thumbnail(id); err != ErrNoThumbnail {
+		t.Errorf("truncated image: %v", err)
+	}
+	if s.HasThumbnail(id) {
+		t.Error("truncated image still has a thumbnail")
+	}
+
+	// a blob that cannot be read may be readable later
+	id, _, _, _, err = s.New(bytes.NewReader(pngData.Bytes()), "corrupt.png", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, blob, _ := s.lookup(id)
+	raw, err := ioutil.ReadFile(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := append([]byte{}, raw...)
+	for i := len(raw) / 2; i < len(raw)-8; i++ {
+		raw[i] = 0xff
+	}
+	if err = ioutil.WriteFile(blob, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = s.Thumbnail(id); err == nil || err == ErrNoThumbnail {
+		t.Errorf("unreadable blob: %v", err)
+	}
+	if !s.HasThumbnail(id) {
+		t.Error("a read error was recorded as the image having no thumbnail")
+	}
+	if err = ioutil.WriteFile(blob, saved, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, _, err := s.Thumbnail(id)
+	if err != nil {
+		t.Fatalf("repaired blob: %s", err)
+	}
+	f.Close()
+}
+
+func TestThumbnailOrientation(t *testing.T) {
+	// the left half is black and the right half white
+	img := image.NewGray(image.Rect(0, 0, 64, 32))
+	for y := 0; y < 32; y++ {
+		for x := 32; x < 64; x++ {
+			img.SetGray(x, y, color.Gray{255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	exif := append(append([]byte{}, jpegExif...), orientationExif(6)...)
+	seg := []byte{0xff, 0xe1, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(exif)+2))
+	data := append(append(append(append([]byte{}, buf.Bytes()[:2]...), seg...), exif...), buf.Bytes()[2:]...)
+
+	s, _ := newTestStorage(t)
+	s.ThumbSize = 32
+	id, _, _, _, err := s.New(bytes.NewReader(data), "rotated.jpg", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _, err := s.Thumbnail(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumb, err := jpeg.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rotated 90° clockwise, the left half is at the top
+	if b := thumb.Bounds(); b.Dx() != 16 || b.Dy() != 32 {
+		t.Fatalf("thumbnail is %dx%d, want 16x32", b.Dx(), b.Dy())
+	}
+	top, _, _, _ := thumb.At(8, 4).RGBA()
+	bottom, _, _, _ := thumb.At(8, 28).RGBA()
+	if top > 0x4000 || bottom < 0xc000 {
+		t.Errorf("top is %#x and bottom %#x, want dark and light", top, bottom)
+	}
+}
+
+func TestImageOrientation(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   []byte
+		want   uint16
+	}{
+		{"jpeg", "jpeg", testJpeg(t, testExif(8)), 8},
+		{"jpeg without exif", "jpeg", testJpeg(t, nil), 0},
+		{"png", "png", testPng(t, pngChunk("eXIf", testExif(3))), 3},
+		{"png without exif", "png", testPng(t), 0},
+		{"webp", "webp", testWebp(webpChunk("VP8 ", []byte("data")), webpChunk("EXIF", testExif(5))), 5},
+		{"gif", "gif", []byte("GIF89a"), 0},
+	}
+	for _, test := range tests {
+		if o := imageOrientation(bytes.NewReader(test.data), test.format); o != test.want {
+			t.Errorf("%s: orientation %d, want %d", test.name, o, test.want)
+		}
+	}
+}
@@ -14,18 +14,31 @@ import (
 
 var templates *template.Template
 
+// builtinPages are templates shipped with gomf for its own features; a file
+// with the same name in pages/ overrides them
+var builtinPages = map[string]string{}
+
 func initWebsite() {
 	pages, err := ioutil.ReadDir("pages")
 	if err != nil {
 		panic(err)
 	}
 
-	templates = template.Must(template.ParseGlob("pages/*.html"))
-
+	templates = template.New("_builtin")
+	names := make(map[string]bool)
+	for name, text := range builtinPages {
+		template.Must(templates.New(name).Parse(text))
+		names[name] = true
+	}
+	template.Must(templates.ParseGlob("pages/*.html"))
 	for _, page := range pages {
-		if path.Ext(page.Name()) == ".html" && page.Name()[0] != '_' {
-			http.HandleFunc("/"+page.Name(), handlePage)
-			if page.Name() == "index.html" {
+		names[page.Name()] = true
+	}
+
+	for name := range names {
+		if path.Ext(name) == ".html" && name[0] != '_' {
+			http.HandleFunc("/"+name, handlePage)
+			if name == "index.html" {
 				http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 					if r.URL.Path != "/" {
 						http.NotFound(w, r)
@@ -64,6 +77,8 @@ type pageContext struct {
 	MaxSize      string
 	Pages        map[string]string
 	Result       response
+	Id           string
+	Nonce        string
 }
 
 func newContext() pageContext {